@@ -1,20 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
 
 	"github.com/ladecadence/GBShooperGo/pkg/color"
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
 	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
 )
 
 const (
 	VER_MAYOR = 0
 	VER_MINOR = 2
+
+	// exit codes
+	EXIT_ERROR          = 1
+	EXIT_NO_DEVICE      = 2
+	EXIT_TIMEOUT        = 3
+	EXIT_CHECKSUM       = 4
+	EXIT_DEVICE_ERROR   = 5
+	EXIT_DEVICE_TIMEOUT = 6
+	EXIT_BAD_ID         = 7
+	EXIT_NO_CART        = 8
+	EXIT_LOCKED         = 9
+	EXIT_VERIFY         = 10
+	EXIT_CANCELLED      = 130
 )
 
 func GBSHelp() {
@@ -26,7 +44,9 @@ func GBSHelp() {
 	fmt.Println()
 	fmt.Println("Actions:")
 	fmt.Println("\t --version: prints the software version.")
+	fmt.Println("\t --list-devices: lists the connected GBShoopers.")
 	fmt.Println("\t --status: checks the hardware.")
+	fmt.Println("\t --reset: brings back the hardware after an interrupted transfer.")
 	fmt.Println("\t --id: gets the ID of the flash chip.")
 	fmt.Println("\t --read-header: gets header information, mapper and RAM/ROM sizes.")
 	fmt.Println("\t --erase-flash: clears the contents of the flash chip.")
@@ -36,28 +56,527 @@ func GBSHelp() {
 	fmt.Println("\t\t  --size N: Specify ROM size:")
 	fmt.Print("\t\t\t 1=32KB, 2=64KB, 3=128KB, 4=256KB, 5=512KB, 6=1MB, ")
 	fmt.Println("7=2MB, 8=4MB")
-	fmt.Println("\t\t If no size is specified, 32KB are read")
+	fmt.Println("\t\t  --auto: takes the size from the cart header, the default.")
+	fmt.Println("\t\t\t With --size too, N is used when the header is unknown.")
+	fmt.Println("\t\t  --offset N: starts reading at byte N, 0x for hex.")
+	fmt.Println("\t\t  --length N: reads N bytes, up to the end of the ROM by default.")
+	fmt.Println("\t\t  --bank B: reads 16KB bank B, --offset and --length within it.")
+	fmt.Println("\t\t\t Ranges need firmware with address support.")
+	fmt.Println("\t\t If the header is unknown and no size is specified, 32KB are read")
 	fmt.Println("\t --write-flash: writes the flash with contents from [file].")
+	fmt.Println("\t\toptions:")
+	fmt.Println("\t\t  --offset N: writes [file] at byte N of the flash, 0x for hex.")
+	fmt.Println("\t\t  --bank B: writes [file] at 16KB bank B, --offset within it.")
+	fmt.Println("\t\t\t The range has to fit in the chip and be erased, and")
+	fmt.Println("\t\t\t needs firmware with address support.")
 	fmt.Print("\t --read-ram: reads the contents of the save RAM ")
 	fmt.Println("and writes it on [file].")
 	fmt.Println("\t\toptions:")
 	fmt.Println("\t\t  --size N: Specify RAM size:")
 	fmt.Println("\t\t\t 1=8KB, 2=32KB, 3=1MB")
-	fmt.Println("\t\t If no size is specified, 8KB are read")
+	fmt.Println("\t\t  --auto: as with --read-flash.")
+	fmt.Println("\t\t  --offset N, --length N, --bank B: as with --read-flash,")
+	fmt.Println("\t\t\t with 8KB banks.")
+	fmt.Println("\t\t If the header is unknown and no size is specified, 8KB are read")
 	fmt.Println("\t --write-ram: writes the save RAM with contents from [file].")
 	fmt.Println("\t --erase-ram: clears the contents of the save RAM with 0's.")
 	fmt.Println("\t\toptions:")
 	fmt.Println("\t\t  --size N: Specify RAM size:")
 	fmt.Println("\t\t\t 1=8KB, 2=32KB, 3=1MB")
 	fmt.Println("\t\t If no size is specified, 8KB are erased")
-	fmt.Println("\t --help: show this help.\n")
+	fmt.Println("\t verify: compares the flash with [file], without making a dump.")
+	fmt.Println("\t\toptions:")
+	fmt.Println("\t\t  --ram F: also compares the save RAM with file F, or only")
+	fmt.Println("\t\t\t it when no [file] is given.")
+	fmt.Println("\t --help: show this help.")
+	fmt.Println()
+	fmt.Println("Options:")
+	fmt.Println("\t --backend B: how to reach the hardware, ftdi (libftdi, default)")
+	fmt.Println("\t\t or serial (kernel ftdi_sio driver).")
+	fmt.Println("\t --port P: serial port, instead of looking for the device.")
+	fmt.Println("\t --device D: serial number or index of the GBShooper to use")
+	fmt.Println("\t\t when several are connected, see --list-devices.")
+	fmt.Println("\t --retries N: times a chunk with a bad checksum is sent again, 3 by")
+	fmt.Println("\t\t default. Firmware older than 1.1 can't resend one: reads start over")
+	fmt.Println("\t\t and writes fail.")
+	fmt.Println("\t --backoff MS: milliseconds to wait before the first retry, 10 by")
+	fmt.Println("\t\t default, doubled on each one.")
+	fmt.Println("\t --trace F: records all the traffic with the hardware in file F.")
+	fmt.Println("\t --replay F: plays back the trace in file F instead of using the hardware.")
+	fmt.Println("\t --wait S: waits up to S seconds for the GBShooper to be connected,")
+	fmt.Println("\t\t or released by another gbshooper, 0 waits forever.")
+	fmt.Println("\t --wait-cart: waits until a cart is detected, up to the --wait timeout if")
+	fmt.Println("\t\t given. The GBShooper itself is only waited for with --wait.")
+	fmt.Println("\t --verify: reads the cart back after writing and compares it with [file].")
+	fmt.Println()
+	fmt.Println("Exit codes:")
+	fmt.Println("\t 0: ok, 1: error, 2: no device found, 3: timeout, 4: bad checksum,")
+	fmt.Println("\t 5: device reported an error, 6: device reported a timeout, 7: bad GBShooper ID,")
+	fmt.Println("\t 8: no cart detected, 9: GBShooper in use by another process,")
+	fmt.Println("\t 10: verification failed, 130: cancelled with Ctrl-C.")
+	fmt.Println()
+}
+
+// GBSExitCode tells apart the failures scripts may want to handle.
+func GBSExitCode(err error) int {
+	var checksum *flashcart.ChecksumError
+	var image *flashcart.ImageCRCError
+	var verify *flashcart.VerifyError
+	switch {
+	case errors.Is(err, comms.ErrNoDevice), errors.Is(err, comms.ErrSeveralDevices):
+		return EXIT_NO_DEVICE
+	case errors.Is(err, comms.ErrTimeout):
+		return EXIT_TIMEOUT
+	case errors.As(err, &checksum), errors.As(err, &image):
+		return EXIT_CHECKSUM
+	case errors.Is(err, flashcart.ErrDeviceError):
+		return EXIT_DEVICE_ERROR
+	case errors.Is(err, flashcart.ErrDeviceTimeout):
+		return EXIT_DEVICE_TIMEOUT
+	case errors.Is(err, flashcart.ErrBadID):
+		return EXIT_BAD_ID
+	case errors.Is(err, flashcart.ErrNoCart):
+		return EXIT_NO_CART
+	case errors.Is(err, comms.ErrLocked):
+		return EXIT_LOCKED
+	case errors.As(err, &verify):
+		return EXIT_VERIFY
+	case errors.Is(err, context.Canceled):
+		return EXIT_CANCELLED
+	}
+	return EXIT_ERROR
 }
 
 func GBSVersion() {
 	fmt.Println(color.Green + "☄️  GBShooper version: " + color.Purple + strconv.Itoa(VER_MAYOR) + "." + strconv.Itoa(VER_MINOR) + color.Reset)
 }
 
+// global options, valid anywhere in the command line
+var backend = "ftdi"
+var port = ""
+var device = ""
+var retry = flashcart.DefaultRetry
+var trace = ""
+var replay = ""
+var wait = -1 // seconds, -1 to fail at once and 0 to wait forever
+var waitCart = false
+var verify = false
+
+// GBSOptions parses the global options and removes them from os.Args,
+// leaving the action and its own options.
+func GBSOptions() {
+	args := os.Args[:1]
+	for i := 1; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--wait-cart":
+			waitCart = true
+		case "--verify":
+			verify = true
+		case "--backend", "--port", "--device", "--retries", "--backoff", "--trace", "--replay", "--wait":
+			if i+1 >= len(os.Args) {
+				GBSHelp()
+				os.Exit(1)
+			}
+			switch os.Args[i] {
+			case "--backend":
+				backend = os.Args[i+1]
+			case "--port":
+				port = os.Args[i+1]
+			case "--device":
+				device = os.Args[i+1]
+			case "--trace":
+				trace = os.Args[i+1]
+			case "--replay":
+				replay = os.Args[i+1]
+			case "--retries", "--backoff", "--wait":
+				n, err := strconv.Atoi(os.Args[i+1])
+				if err != nil || n < 0 {
+					GBSHelp()
+					os.Exit(1)
+				}
+				switch os.Args[i] {
+				case "--retries":
+					retry.Attempts = n
+				case "--backoff":
+					retry.Backoff = time.Duration(n) * time.Millisecond
+				case "--wait":
+					wait = n
+				}
+			}
+			i++
+		default:
+			args = append(args, os.Args[i])
+		}
+	}
+	os.Args = args
+}
+
+// GBSBackend opens the GBShooper with the selected backend.
+func GBSBackend() (comms.Transport, error) {
+	switch backend {
+	case "ftdi":
+		return comms.OpenFTDI(device)
+	case "serial":
+		return comms.OpenSerial(port, device)
+	}
+	fmt.Println("❌ " + color.Red + "Unknown backend: " + backend + color.Reset)
+	os.Exit(1)
+	return nil, nil
+}
+
+// GBSWaitContext bounds a wait with the --wait timeout, without --wait
+// it doesn't time out.
+func GBSWaitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if wait > 0 {
+		return context.WithTimeout(ctx, time.Duration(wait)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
+// GBSTransport opens the link to the GBShooper, without talking to it.
+// With --wait a missing or busy GBShooper is waited for.
+func GBSTransport(ctx context.Context) comms.Transport {
+	var gbs comms.Transport
+	var err error
+	if replay != "" {
+		gbs, err = GBSReplay(replay)
+	} else {
+		gbs, err = GBSBackend()
+		missing := errors.Is(err, comms.ErrNoDevice)
+		busy := errors.Is(err, comms.ErrLocked)
+		if (missing || busy) && wait >= 0 {
+			if busy {
+				fmt.Println(color.Yellow + "⏳ " + err.Error() + ", waiting..." + color.Reset)
+			} else {
+				fmt.Println(color.Yellow + "⏳ Waiting for a GBShooper to be connected..." + color.Reset)
+			}
+			wctx, cancel := GBSWaitContext(ctx)
+			gbs, err = comms.WaitDevice(wctx, GBSBackend)
+			cancel()
+			if err == nil && missing {
+				fmt.Println(color.Green + "🔌 GBShooper connected." + color.Reset)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Println("❌ " + color.Red + "Hardware error: ")
+		fmt.Println(err.Error() + color.Reset)
+		os.Exit(GBSExitCode(err))
+	}
+	if trace != "" {
+		file, err := os.Create(trace)
+		if err != nil {
+			gbs.Close()
+			fmt.Println("❌ "+color.Red+"Can't create trace file: ", err.Error()+color.Reset)
+			os.Exit(1)
+		}
+		gbs = comms.NewTracer(gbs, file)
+	}
+	return gbs
+}
+
+// GBSOpen connects to the GBShooper and checks it answers. With
+// --wait-cart it also waits for a cart to be inserted.
+func GBSOpen(ctx context.Context) *flashcart.Session {
+	gbs := GBSTransport(ctx)
+	session, err := flashcart.NewSession(ctx, gbs)
+	if err == nil && waitCart {
+		err = GBSWaitCart(ctx, session)
+	}
+	if err != nil {
+		if session != nil {
+			session.Close()
+		} else {
+			gbs.Close()
+		}
+		fmt.Println("❌ " + color.Red + "Hardware error: ")
+		fmt.Println(err.Error() + color.Reset)
+		os.Exit(GBSExitCode(err))
+	}
+	session.Retry = retry
+	session.Verify = verify
+	return session
+}
+
+// GBSWaitCart waits until the cart header reads valid.
+func GBSWaitCart(ctx context.Context, gbs *flashcart.Session) error {
+	header, err := gbs.ReadHeader(ctx)
+	if err != nil || header.Valid() {
+		return err
+	}
+	fmt.Println(color.Yellow + "⏳ Waiting for a cart to be inserted..." + color.Reset)
+	wctx, cancel := GBSWaitContext(ctx)
+	defer cancel()
+	header, err = gbs.WaitCart(wctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println(color.Green + "🎮 Cart detected: " + color.Purple + header.Title + color.Reset)
+	return nil
+}
+
+// GBSReplay plays back a trace file instead of talking to the hardware.
+func GBSReplay(filename string) (comms.Transport, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return comms.OpenReplay(file)
+}
+
+// sizes selected with --size N
+var romSizes = []int64{flashcart.S_32K, flashcart.S_64K, flashcart.S_128K, flashcart.S_256K,
+	flashcart.S_512K, flashcart.S_1MB, flashcart.S_2MB, flashcart.S_4MB}
+var ramSizes = []int64{flashcart.S_8K, flashcart.S_32K, flashcart.S_1MB}
+
+// GBSSizeArgs parses the --size N and --auto options of an action and
+// returns the rest of its arguments. size is 0 when not given, auto is
+// set unless only --size was.
+func GBSSizeArgs(args []string, sizes []int64) (size int64, auto bool, rest []string) {
+	sized := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--auto":
+			auto = true
+		case "--size":
+			if i+1 >= len(args) {
+				GBSHelp()
+				os.Exit(1)
+			}
+			// unknown sizes select the smallest
+			s, _ := strconv.Atoi(args[i+1])
+			size = sizes[0]
+			if s >= 1 && s <= len(sizes) {
+				size = sizes[s-1]
+			}
+			sized = true
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return size, auto || !sized, rest
+}
+
+// GBSRangeArgs parses the --offset N, --length N and --bank B options of
+// a read and returns the rest of its arguments. With --bank the offset is
+// within the bank, and the length defaults to the rest of it.
+func GBSRangeArgs(args []string, bankSize int64) (offset int64, length int64, rest []string) {
+	var bank int64 = -1
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--offset", "--length", "--bank":
+			if i+1 >= len(args) {
+				GBSHelp()
+				os.Exit(1)
+			}
+			n, err := strconv.ParseInt(args[i+1], 0, 64)
+			if err != nil || n < 0 {
+				GBSHelp()
+				os.Exit(1)
+			}
+			switch args[i] {
+			case "--offset":
+				offset = n
+			case "--length":
+				length = n
+			case "--bank":
+				bank = n
+			}
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	if bank >= 0 {
+		if offset >= bankSize {
+			GBSHelp()
+			os.Exit(1)
+		}
+		if length == 0 {
+			length = bankSize - offset
+		}
+		offset += bank * bankSize
+	}
+	return offset, length, rest
+}
+
+// GBSRange works out the length of a read from offset, the rest of size
+// unless it was given, and prints the range when it isn't the whole size.
+func GBSRange(gbs *flashcart.Session, name string, offset int64, length int64, size int64) int64 {
+	if length == 0 {
+		length = size - offset
+	}
+	if length <= 0 {
+		gbs.Close()
+		fmt.Println("❌ " + color.Red + "Offset past the end of the " + name + color.Reset)
+		os.Exit(1)
+	}
+	if offset > 0 || length != size {
+		fmt.Println(color.Green + "📍 " + name + " range: " + color.Purple + fmt.Sprintf("0x%06x-0x%06x", offset, offset+length-1) + ", " + GBSSizeName(length) + color.Reset)
+	}
+	return length
+}
+
+// GBSSizeName prints a size in bytes like the header tables.
+func GBSSizeName(size int64) string {
+	switch {
+	case size >= flashcart.S_1MB && size%flashcart.S_1MB == 0:
+		return strconv.FormatInt(size/flashcart.S_1MB, 10) + "MB"
+	case size >= 1024 && size%1024 == 0:
+		return strconv.FormatInt(size/1024, 10) + "KB"
+	}
+	return strconv.FormatInt(size, 10) + " bytes"
+}
+
+// GBSAutoSize reads the ROM or RAM size from the cart header. When the
+// header can't tell, it warns and falls back to size, or to def if no
+// size was given.
+func GBSAutoSize(ctx context.Context, gbs *flashcart.Session, ram bool, size int64, def int64) int64 {
+	name := "ROM"
+	if ram {
+		name = "RAM"
+	}
+	header, err := gbs.ReadHeader(ctx)
+	if err != nil {
+		gbs.Close()
+		fmt.Println("❌ " + color.Red + "Hardware error: ")
+		fmt.Println(err.Error() + color.Reset)
+		os.Exit(GBSExitCode(err))
+	}
+	var auto int64
+	if ram {
+		auto, err = header.RAMDumpSize()
+	} else {
+		auto, err = header.ROMDumpSize()
+	}
+	if err == nil && auto == 0 {
+		if size == 0 {
+			gbs.Close()
+			fmt.Println("❌ " + color.Red + header.Title + " has no save RAM, use --size to force one." + color.Reset)
+			os.Exit(1)
+		}
+		err = fmt.Errorf("%s has no save RAM", header.Title)
+	}
+	if err != nil {
+		if size == 0 {
+			size = def
+		}
+		fmt.Println(color.Yellow + "⚠️  " + err.Error() + ", using " + GBSSizeName(size) + " of " + name + color.Reset)
+		return size
+	}
+	fmt.Println(color.Green + "📏 " + name + " size from header: " + color.Purple + GBSSizeName(auto) + color.Reset)
+	return auto
+}
+
+// GBSRetries tells how many chunks had to be sent again, and the image
+// CRC32 when the device checked it too.
+func GBSRetries(gbs *flashcart.Session) {
+	if gbs.Retries > 0 {
+		fmt.Println(color.Yellow + "🔁 Chunks sent again: " + color.Purple + strconv.Itoa(gbs.Retries) + color.Reset)
+	}
+	if gbs.CRC32Checked {
+		fmt.Println(color.Green + "🔒 CRC32 verified: " + color.Purple + fmt.Sprintf("%08x", gbs.CRC32) + color.Reset)
+	}
+}
+
+// GBSNoRetry tells when a bad chunk failed a write because the firmware
+// can't take it again.
+func GBSNoRetry(gbs *flashcart.Session, err error) {
+	var checksum *flashcart.ChecksumError
+	if errors.As(err, &checksum) && !checksum.Read && gbs.Link.Features&flashcart.FEATURE_RETRY == 0 {
+		fmt.Println(color.Yellow + "⚠️  This firmware can't take a chunk again, run the write again." + color.Reset)
+	}
+}
+
+// GBSMismatches lists the first bytes differing when verification failed.
+func GBSMismatches(err error) {
+	var verify *flashcart.VerifyError
+	if !errors.As(err, &verify) {
+		return
+	}
+	fmt.Print(color.Reset)
+	GBSDiff(verify.Comparison)
+}
+
+// GBSDiff lists the first bytes differing in a comparison.
+func GBSDiff(cmp flashcart.Comparison) {
+	for _, m := range cmp.Mismatches {
+		fmt.Printf("\t 0x%06x bank %d: expected 0x%02x, got 0x%02x\n", m.Address, m.Bank, m.Expected, m.Actual)
+	}
+	if cmp.Count > int64(len(cmp.Mismatches)) {
+		fmt.Printf("\t ... and %d more\n", cmp.Count-int64(len(cmp.Mismatches)))
+	}
+}
+
+// GBSCompare compares the cart with filename using compare, showing the
+// progress, and prints the chunk and bank statistics. It tells whether
+// they match.
+func GBSCompare(ctx context.Context, name string, filename string, compare func(context.Context, string, chan bool, chan int64, chan error) (flashcart.Comparison, error)) (bool, error) {
+	// sync
+	progress := make(chan int64)
+	finished := make(chan bool)
+	errchan := make(chan error)
+	// the comparison, once compare returns after finishing
+	result := make(chan flashcart.Comparison, 1)
+	var err error
+
+	// start
+	bar := progressbar.NewOptions(100, progressbar.OptionClearOnFinish(), progressbar.OptionSetPredictTime(false), progressbar.OptionSetWidth(20), progressbar.OptionSetTheme(progressbar.ThemeUnicode))
+	fmt.Println(color.Yellow + "🔍 Comparing " + name + " with " + filename + "... " + color.Reset)
+	go func() {
+		cmp, _ := compare(ctx, filename, finished, progress, errchan)
+		result <- cmp
+	}()
+outer:
+	for {
+		select {
+		case <-finished:
+			break outer
+		case percent := <-progress:
+			bar.Set(int(percent))
+		case e := <-errchan:
+			err = e
+			// let it finish
+			<-finished
+			break outer
+		}
+	}
+	bar.Clear()
+	if err != nil {
+		return false, err
+	}
+	cmp := <-result
+
+	if cmp.Match() {
+		fmt.Println(color.Green + "✅ " + name + " matches: " + color.Purple + strconv.FormatInt(cmp.Size, 10) + " bytes, " +
+			strconv.FormatInt(cmp.Chunks, 10) + " chunks, " + strconv.Itoa(len(cmp.Banks)) + " banks" + color.Reset)
+		return true, nil
+	}
+	fmt.Println(color.Red + "❌ " + name + " differs: " + color.Purple + strconv.FormatInt(cmp.Count, 10) + " bytes in " +
+		strconv.FormatInt(cmp.BadChunks, 10) + " of " + strconv.FormatInt(cmp.Chunks, 10) + " chunks" + color.Reset)
+	good := 0
+	for _, b := range cmp.Banks {
+		if b.Count == 0 {
+			good++
+			continue
+		}
+		fmt.Printf("\t bank %d: %d bytes in %d of %d chunks\n", b.Bank, b.Count, b.BadChunks, b.Chunks)
+	}
+	fmt.Printf("\t %d of %d banks match\n", good, len(cmp.Banks))
+	fmt.Println("First differences:")
+	GBSDiff(cmp)
+	return false, nil
+}
+
 func main() {
+	GBSOptions()
+
+	// Ctrl-C ends the running operation cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	// no args, print help
 	if len(os.Args) == 1 {
 		GBSHelp()
@@ -70,36 +589,102 @@ func main() {
 		os.Exit(0)
 	}
 
-	if os.Args[1] == "--status" {
-		status, err := flashcart.GBSStatus()
+	if os.Args[1] == "--list-devices" {
+		var list []comms.DeviceInfo
+		var err error
+		switch backend {
+		case "ftdi":
+			list, err = comms.ListFTDI()
+		case "serial":
+			list, err = comms.ListSerial()
+		default:
+			fmt.Println("❌ " + color.Red + "Unknown backend: " + backend + color.Reset)
+			os.Exit(1)
+		}
 		if err != nil {
 			fmt.Println("❌ " + color.Red + "Hardware error: ")
 			fmt.Println(err.Error() + color.Reset)
-			os.Exit(1)
+			os.Exit(GBSExitCode(err))
+		}
+		GBSVersion()
+		if len(list) == 0 {
+			fmt.Println(color.Yellow + "🔌 No GBShooper found." + color.Reset)
+		}
+		for _, d := range list {
+			fmt.Println(color.Green + "🔌 " + strconv.Itoa(d.Index) + ": " + color.Purple + d.Serial + " " + d.Path + color.Reset)
+		}
+		os.Exit(0)
+	}
+
+	if os.Args[1] == "--reset" {
+		gbs := GBSTransport(ctx)
+		GBSVersion()
+		fmt.Println(color.Yellow + "🚑 Recovering GBShooper... " + color.Reset)
+		rec, err := flashcart.GBSRecover(ctx, gbs)
+		gbs.Close()
+		if rec.Drained > 0 {
+			fmt.Println(color.Green + "🧹 Stale bytes drained: " + color.Purple + strconv.Itoa(rec.Drained) + color.Reset)
+		}
+		if rec.Ends > 0 {
+			fmt.Println(color.Green + "🛑 CMD_END packets sent: " + color.Purple + strconv.Itoa(rec.Ends) + color.Reset)
 		}
+		if rec.Realigned {
+			fmt.Println(color.Green + "🧩 Completed a half sent packet." + color.Reset)
+		}
+		if rec.Committed {
+			fmt.Println(color.Yellow + "⚠️  A half sent chunk was completed with 0xFF and may have been written." + color.Reset)
+		}
+		if rec.LinkReset {
+			fmt.Println(color.Green + "🔗 Found at " + color.Purple + strconv.Itoa(rec.Baudrate) + " baud" + color.Green + ", link reset." + color.Reset)
+		}
+		if err != nil {
+			fmt.Println("❌ "+color.Red+"Error recovering the hardware: ", err.Error()+color.Reset)
+			os.Exit(GBSExitCode(err))
+		}
+		if rec.Drained == 0 && rec.Ends == 0 && !rec.LinkReset && !rec.Committed {
+			fmt.Println(color.Green + "✅ GBShooper was idle." + color.Reset)
+		} else {
+			fmt.Println(color.Green + "✅ GBShooper recovered." + color.Reset)
+		}
+		os.Exit(0)
+	}
+
+	if os.Args[1] == "--status" {
+		gbs := GBSOpen(ctx)
+		status := gbs.Version
+		link := gbs.Link
+		gbs.Close()
 		GBSVersion()
 		fmt.Println(color.Green + "🔩 Hardware version: " + color.Purple + string(status.VersionMayor) + "." + string(status.VersionMinor) + color.Reset)
+		fmt.Println(color.Green + "🔗 Link: " + color.Purple + strconv.Itoa(link.Baudrate) + " baud, " + strconv.Itoa(link.ChunkSize) + " byte chunks" + color.Reset)
 		os.Exit(0)
 	}
 
 	if os.Args[1] == "--id" {
-		id, err := flashcart.GBSChipID()
+		gbs := GBSOpen(ctx)
+		id, err := gbs.ChipID(ctx)
+		gbs.Close()
 		if err != nil {
 			fmt.Println("❌ " + color.Red + "Hardware error: ")
 			fmt.Println(err.Error() + color.Reset)
-			os.Exit(1)
+			os.Exit(GBSExitCode(err))
 		}
 		GBSVersion()
 		fmt.Println(color.Green + "🪪  Flash chip ID: " + id.Manufacturer + ", " + id.Chip + color.Reset)
+		if id.Size > 0 {
+			fmt.Println(color.Green + "📦 Flash size: " + color.Purple + GBSSizeName(int64(id.Size)) + color.Reset)
+		}
 		os.Exit(0)
 	}
 
 	if os.Args[1] == "--read-header" {
-		header, err := flashcart.GBSReadHeader()
+		gbs := GBSOpen(ctx)
+		header, err := gbs.ReadHeader(ctx)
+		gbs.Close()
 		if err != nil {
 			fmt.Println("❌ " + color.Red + "Hardware error: ")
 			fmt.Println(err.Error() + color.Reset)
-			os.Exit(1)
+			os.Exit(GBSExitCode(err))
 		}
 		GBSVersion()
 		fmt.Println(color.Green + "👤 Cart name: " + color.Purple + header.Title + color.Reset)
@@ -117,44 +702,64 @@ func main() {
 			time.Sleep(100 * time.Millisecond)
 			bar.Add(1)
 		}()
-		err := flashcart.GBSEraseFlash()
+		gbs := GBSOpen(ctx)
+		err := gbs.EraseFlash(ctx)
+		gbs.Close()
 		if err != nil {
 			bar.Clear()
 			fmt.Println("❌ " + color.Red + "Error: ")
 			fmt.Println(err.Error() + color.Reset)
-			os.Exit(1)
+			os.Exit(GBSExitCode(err))
 		}
 		bar.Clear()
 		fmt.Println(color.Green + "✅ FLASH erased." + color.Reset)
 	}
 
 	if os.Args[1] == "--write-flash" {
-		if len(os.Args) < 3 {
+		offset, _, args := GBSRangeArgs(os.Args[2:], flashcart.ROM_BANK_SIZE)
+		if len(args) != 1 || slices.Contains(os.Args, "--length") {
 			GBSHelp()
 			os.Exit(1)
 		}
+		// with --offset or --bank the range is checked first
+		ranged := len(args) < len(os.Args)-2
 
-		romFile := os.Args[2]
+		romFile := args[0]
 
 		// check we can open the file
 		rom, err := os.Open(romFile)
 		if err != nil {
-			fmt.Println("❌ "+color.Red+"Can't open file: ", os.Args[2])
+			fmt.Println("❌ "+color.Red+"Can't open file: ", romFile)
 			os.Exit(1)
 		}
+		stats, err := rom.Stat()
 		rom.Close()
+		if err != nil {
+			fmt.Println("❌ "+color.Red+"Can't open file: ", romFile)
+			os.Exit(1)
+		}
 
 		// sync
 		progress := make(chan int64)
 		finished := make(chan bool)
 		errchan := make(chan error)
 
+		gbs := GBSOpen(ctx)
+
 		// start
 		bar := progressbar.NewOptions(100, progressbar.OptionClearOnFinish(), progressbar.OptionSetPredictTime(false), progressbar.OptionSetWidth(20), progressbar.OptionSetTheme(progressbar.ThemeUnicode))
 		GBSVersion()
+		// an empty file is left to WriteFlashAt, which tells so
+		if ranged && stats.Size() > 0 {
+			GBSRange(gbs, "ROM", offset, stats.Size(), 0)
+		}
 		fmt.Println(color.Yellow + "📝 Writing FLASH... " + color.Reset)
 		go func() {
-			err = flashcart.GBSWriteFlash(romFile, finished, progress, errchan)
+			if ranged {
+				gbs.WriteFlashAt(ctx, romFile, offset, finished, progress, errchan)
+			} else {
+				gbs.WriteFlash(ctx, romFile, finished, progress, errchan)
+			}
 		}()
 	writeflash_outer:
 		for {
@@ -168,54 +773,31 @@ func main() {
 				break writeflash_outer
 			}
 		}
+		gbs.Close()
 
 		if err != nil {
 			bar.Clear()
 			fmt.Println("❌ "+color.Red+"Error writing flash: ", err.Error())
-			os.Exit(1)
+			GBSMismatches(err)
+			GBSNoRetry(gbs, err)
+			os.Exit(GBSExitCode(err))
 		}
 		bar.Clear()
 		fmt.Println(color.Green + "✅ FLASH written." + color.Reset)
+		if verify {
+			fmt.Println(color.Green + "🔍 FLASH verified." + color.Reset)
+		}
+		GBSRetries(gbs)
 	}
 
 	if os.Args[1] == "--read-flash" {
-		if len(os.Args) < 3 {
+		size, auto, args := GBSSizeArgs(os.Args[2:], romSizes)
+		offset, length, args := GBSRangeArgs(args, flashcart.ROM_BANK_SIZE)
+		if len(args) != 1 {
 			GBSHelp()
 			os.Exit(1)
 		}
-		var size int64 = 0
-		romFile := ""
-		if os.Args[2] == "--size" {
-			if len(os.Args) < 5 {
-				GBSHelp()
-				os.Exit(1)
-			}
-			s, _ := strconv.Atoi(os.Args[3])
-			switch s {
-			case 1:
-				size = flashcart.S_32K
-			case 2:
-				size = flashcart.S_64K
-			case 3:
-				size = flashcart.S_128K
-			case 4:
-				size = flashcart.S_256K
-			case 5:
-				size = flashcart.S_512K
-			case 6:
-				size = flashcart.S_1MB
-			case 7:
-				size = flashcart.S_2MB
-			case 8:
-				size = flashcart.S_4MB
-			default:
-				size = flashcart.S_32K
-			}
-			romFile = os.Args[4]
-		} else {
-			romFile = os.Args[2]
-			size = flashcart.S_32K
-		}
+		romFile := args[0]
 
 		// sync
 		progress := make(chan int64)
@@ -223,12 +805,18 @@ func main() {
 		errchan := make(chan error)
 		var err error
 
+		gbs := GBSOpen(ctx)
+
 		// start
 		bar := progressbar.NewOptions(100, progressbar.OptionClearOnFinish(), progressbar.OptionSetPredictTime(false), progressbar.OptionSetWidth(20), progressbar.OptionSetTheme(progressbar.ThemeUnicode))
 		GBSVersion()
+		if auto && length == 0 {
+			size = GBSAutoSize(ctx, gbs, false, size, flashcart.S_32K)
+		}
+		length = GBSRange(gbs, "ROM", offset, length, size)
 		fmt.Println(color.Yellow + "📖 Reading FLASH... " + color.Reset)
 		go func() {
-			flashcart.GBSReadFlash(romFile, size, finished, progress, errchan)
+			gbs.ReadFlashRange(ctx, romFile, offset, length, finished, progress, errchan)
 		}()
 	outerreadflash:
 		for {
@@ -242,14 +830,16 @@ func main() {
 				break outerreadflash
 			}
 		}
+		gbs.Close()
 
 		if err != nil {
 			bar.Clear()
 			fmt.Println("❌ "+color.Red+"Error reading flash: ", err.Error())
-			os.Exit(1)
+			os.Exit(GBSExitCode(err))
 		}
 		bar.Clear()
 		fmt.Println(color.Green + "✅ FLASH read." + color.Reset)
+		GBSRetries(gbs)
 	}
 
 	if os.Args[1] == "--write-ram" {
@@ -271,13 +861,16 @@ func main() {
 		// sync
 		progress := make(chan int64)
 		finished := make(chan bool)
+		errchan := make(chan error)
+
+		gbs := GBSOpen(ctx)
 
 		// start
 		bar := progressbar.NewOptions(100, progressbar.OptionClearOnFinish(), progressbar.OptionSetPredictTime(false), progressbar.OptionSetWidth(20), progressbar.OptionSetTheme(progressbar.ThemeUnicode))
 		GBSVersion()
 		fmt.Println(color.Yellow + "📝 Writing RAM... " + color.Reset)
 		go func() {
-			err = flashcart.GBSWriteRAM(ramFile, finished, progress)
+			gbs.WriteRAM(ctx, ramFile, finished, progress, errchan)
 		}()
 	writeram_outer:
 		for {
@@ -286,46 +879,36 @@ func main() {
 				break writeram_outer
 			case percent := <-progress:
 				bar.Set(int(percent))
+			case e := <-errchan:
+				err = e
+				break writeram_outer
 			}
 		}
+		gbs.Close()
 
 		if err != nil {
 			bar.Clear()
 			fmt.Println("❌ "+color.Red+"Error writing RAM: ", err.Error())
-			os.Exit(1)
+			GBSMismatches(err)
+			GBSNoRetry(gbs, err)
+			os.Exit(GBSExitCode(err))
 		}
 		bar.Clear()
 		fmt.Println(color.Green + "✅ RAM written." + color.Reset)
+		if verify {
+			fmt.Println(color.Green + "🔍 RAM verified." + color.Reset)
+		}
+		GBSRetries(gbs)
 	}
 
 	if os.Args[1] == "--read-ram" {
-		if len(os.Args) < 3 {
+		size, auto, args := GBSSizeArgs(os.Args[2:], ramSizes)
+		offset, length, args := GBSRangeArgs(args, flashcart.RAM_BANK_SIZE)
+		if len(args) != 1 {
 			GBSHelp()
 			os.Exit(1)
 		}
-		var size int64 = 0
-		ramFile := ""
-		if os.Args[2] == "--size" {
-			if len(os.Args) < 5 {
-				GBSHelp()
-				os.Exit(1)
-			}
-			s, _ := strconv.Atoi(os.Args[3])
-			switch s {
-			case 1:
-				size = flashcart.S_8K
-			case 2:
-				size = flashcart.S_32K
-			case 3:
-				size = flashcart.S_1MB
-			default:
-				size = flashcart.S_8K
-			}
-			ramFile = os.Args[4]
-		} else {
-			ramFile = os.Args[2]
-			size = flashcart.S_32K
-		}
+		ramFile := args[0]
 
 		// sync
 		progress := make(chan int64)
@@ -333,12 +916,18 @@ func main() {
 		errchan := make(chan error)
 		var err error
 
+		gbs := GBSOpen(ctx)
+
 		// start
 		bar := progressbar.NewOptions(100, progressbar.OptionClearOnFinish(), progressbar.OptionSetPredictTime(false), progressbar.OptionSetWidth(20), progressbar.OptionSetTheme(progressbar.ThemeUnicode))
 		GBSVersion()
+		if auto && length == 0 {
+			size = GBSAutoSize(ctx, gbs, true, size, flashcart.S_8K)
+		}
+		length = GBSRange(gbs, "RAM", offset, length, size)
 		fmt.Println(color.Yellow + "📖 Reading RAM... " + color.Reset)
 		go func() {
-			flashcart.GBSReadRAM(ramFile, size, finished, progress, errchan)
+			gbs.ReadRAMRange(ctx, ramFile, offset, length, finished, progress, errchan)
 		}()
 	outerreadram:
 		for {
@@ -352,14 +941,16 @@ func main() {
 				break outerreadram
 			}
 		}
+		gbs.Close()
 
 		if err != nil {
 			bar.Clear()
 			fmt.Println("❌ "+color.Red+"Error reading RAM: ", err.Error())
-			os.Exit(1)
+			os.Exit(GBSExitCode(err))
 		}
 		bar.Clear()
 		fmt.Println(color.Green + "✅ RAM read." + color.Reset)
+		GBSRetries(gbs)
 	}
 
 	if os.Args[1] == "--erase-ram" {
@@ -394,12 +985,14 @@ func main() {
 		errchan := make(chan error)
 		var err error
 
+		gbs := GBSOpen(ctx)
+
 		// start
 		bar := progressbar.NewOptions(100, progressbar.OptionClearOnFinish(), progressbar.OptionSetPredictTime(false), progressbar.OptionSetWidth(20), progressbar.OptionSetTheme(progressbar.ThemeUnicode))
 		GBSVersion()
 		fmt.Println(color.Yellow + "🧼 Erasing RAM... " + color.Reset)
 		go func() {
-			flashcart.GBSEraseRAM(size, finished, progress, errchan)
+			gbs.EraseRAM(ctx, size, finished, progress, errchan)
 		}()
 	outereraseram:
 		for {
@@ -413,16 +1006,59 @@ func main() {
 				break outereraseram
 			}
 		}
+		gbs.Close()
 
 		if err != nil {
 			bar.Clear()
 			fmt.Println("❌ "+color.Red+"Error erasing RAM: ", err.Error())
-			os.Exit(1)
+			os.Exit(GBSExitCode(err))
 		}
 		bar.Clear()
 		fmt.Println(color.Green + "✅ RAM erased." + color.Reset)
 	}
 
+	if os.Args[1] == "verify" {
+		romFile := ""
+		ramFile := ""
+		for i := 2; i < len(os.Args); i++ {
+			switch {
+			case os.Args[i] == "--ram" && i+1 < len(os.Args):
+				ramFile = os.Args[i+1]
+				i++
+			case romFile == "":
+				romFile = os.Args[i]
+			default:
+				GBSHelp()
+				os.Exit(1)
+			}
+		}
+		if romFile == "" && ramFile == "" {
+			GBSHelp()
+			os.Exit(1)
+		}
+
+		gbs := GBSOpen(ctx)
+		GBSVersion()
+		romMatch, ramMatch := true, true
+		var err error
+		if romFile != "" {
+			romMatch, err = GBSCompare(ctx, "FLASH", romFile, gbs.CompareFlash)
+		}
+		if ramFile != "" && err == nil {
+			ramMatch, err = GBSCompare(ctx, "RAM", ramFile, gbs.CompareRAM)
+		}
+		gbs.Close()
+
+		if err != nil {
+			fmt.Println("❌ "+color.Red+"Error comparing: ", err.Error()+color.Reset)
+			os.Exit(GBSExitCode(err))
+		}
+		GBSRetries(gbs)
+		if !romMatch || !ramMatch {
+			os.Exit(EXIT_VERIFY)
+		}
+	}
+
 	if os.Args[1] == "--help" {
 		GBSHelp()
 		os.Exit(0)
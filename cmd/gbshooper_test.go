@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+func TestRangeArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		bank   int64
+		offset int64
+		length int64
+	}{
+		{"whole", []string{"dump.gb"}, flashcart.ROM_BANK_SIZE, 0, 0},
+		{"offset and length", []string{"--offset", "0x100", "--length", "16", "dump.gb"}, flashcart.ROM_BANK_SIZE, 0x100, 16},
+		{"ROM bank", []string{"--bank", "3", "dump.gb"}, flashcart.ROM_BANK_SIZE, 3 * 0x4000, 0x4000},
+		{"in a ROM bank", []string{"dump.gb", "--bank", "3", "--offset", "0x100"}, flashcart.ROM_BANK_SIZE, 3*0x4000 + 0x100, 0x3F00},
+		{"length in a ROM bank", []string{"--offset", "0x100", "--length", "16", "--bank", "3", "dump.gb"}, flashcart.ROM_BANK_SIZE, 3*0x4000 + 0x100, 16},
+		{"RAM bank", []string{"--bank", "1", "dump.sav"}, flashcart.RAM_BANK_SIZE, 0x2000, 0x2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, length, rest := GBSRangeArgs(tt.args, tt.bank)
+			if offset != tt.offset || length != tt.length {
+				t.Fatalf("got offset 0x%x, length 0x%x", offset, length)
+			}
+			if len(rest) != 1 || !strings.HasPrefix(rest[0], "dump.") {
+				t.Fatalf("left %q", rest)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"no device", fmt.Errorf("%w matching GBS002", comms.ErrNoDevice), EXIT_NO_DEVICE},
+		{"several devices", comms.ErrSeveralDevices, EXIT_NO_DEVICE},
+		{"timeout", comms.ErrTimeout, EXIT_TIMEOUT},
+		{"partial timeout", &comms.PartialError{Data: []uint8{0x44}, Err: comms.ErrTimeout}, EXIT_TIMEOUT},
+		{"chunk checksum", &flashcart.ChecksumError{Chunk: 3, Expected: 0x12, Actual: 0x34, Attempts: 1}, EXIT_CHECKSUM},
+		{"image CRC32", &flashcart.ImageCRCError{Expected: 1, Actual: 2}, EXIT_CHECKSUM},
+		{"status error", &flashcart.StatusError{Op: "erase flash", Status: flashcart.STAT_ERROR}, EXIT_DEVICE_ERROR},
+		{"status timeout", &flashcart.StatusError{Op: "erase flash", Status: flashcart.STAT_TIMEOUT}, EXIT_DEVICE_TIMEOUT},
+		{"other status", &flashcart.StatusError{Op: "erase flash", Status: 0x00}, EXIT_ERROR},
+		{"bad ID", fmt.Errorf("%w: type 0x44, id 0x00", flashcart.ErrBadID), EXIT_BAD_ID},
+		{"no cart", flashcart.ErrNoCart, EXIT_NO_CART},
+		{"locked", &comms.LockError{Key: "GBS001", PID: 1}, EXIT_LOCKED},
+		{"verify", &flashcart.VerifyError{Comparison: flashcart.Comparison{Count: 1, Mismatches: []flashcart.Mismatch{{}}}}, EXIT_VERIFY},
+		{"cancelled", context.Canceled, EXIT_CANCELLED},
+		{"other", errors.New("Can't open file"), EXIT_ERROR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := GBSExitCode(tt.err); code != tt.code {
+				t.Fatalf("%v exits with %d, want %d", tt.err, code, tt.code)
+			}
+		})
+	}
+}
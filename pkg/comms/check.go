@@ -0,0 +1,61 @@
+package comms
+
+import (
+	"hash/crc32"
+)
+
+// ChunkCheck is the integrity check sent along each transferred chunk.
+type ChunkCheck int
+
+const (
+	// CHECK_SUM is the 8-bit additive sum every firmware uses, one packet.
+	CHECK_SUM ChunkCheck = iota
+	// CHECK_CRC16 is CRC-16/CCITT-FALSE, two packets with the high byte first.
+	CHECK_CRC16
+)
+
+// Compute returns the check of data.
+func (c ChunkCheck) Compute(data []uint8) uint16 {
+	if c == CHECK_CRC16 {
+		return CRC16(data)
+	}
+	return uint16(Checksum(data))
+}
+
+// Packets returns the TYPE_DATA packets carrying check, ready to send.
+func (c ChunkCheck) Packets(check uint16) []uint8 {
+	if c == CHECK_CRC16 {
+		return []uint8{TYPE_DATA, uint8(check >> 8), TYPE_DATA, uint8(check)}
+	}
+	return []uint8{TYPE_DATA, uint8(check)}
+}
+
+func Checksum(data []uint8) uint8 {
+	var check uint8 = 0
+	for _, b := range data {
+		check += b
+	}
+	return check
+}
+
+// CRC16 computes CRC-16/CCITT-FALSE (polynomial 0x1021, initial value
+// 0xFFFF), cheap enough for the microcontroller to do bit by bit.
+func CRC16(data []uint8) uint16 {
+	var crc uint16 = 0xFFFF
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// UpdateCRC32 adds data to the IEEE CRC32 of a whole image.
+func UpdateCRC32(crc uint32, data []uint8) uint32 {
+	return crc32.Update(crc, crc32.IEEETable, data)
+}
@@ -0,0 +1,25 @@
+package comms
+
+import "testing"
+
+func TestChunkCheck(t *testing.T) {
+	data := []uint8("123456789")
+	tests := []struct {
+		check   ChunkCheck
+		want    uint16
+		packets []uint8
+	}{
+		// the CRC-16/CCITT-FALSE check value
+		{CHECK_CRC16, 0x29B1, []uint8{TYPE_DATA, 0x29, TYPE_DATA, 0xB1}},
+		{CHECK_SUM, 0xDD, []uint8{TYPE_DATA, 0xDD}},
+	}
+	for _, tt := range tests {
+		got := tt.check.Compute(data)
+		if got != tt.want {
+			t.Fatalf("check %d: 0x%04x, want 0x%04x", tt.check, got, tt.want)
+		}
+		if string(tt.check.Packets(got)) != string(tt.packets) {
+			t.Fatalf("check %d: packets % x", tt.check, tt.check.Packets(got))
+		}
+	}
+}
@@ -1,20 +1,28 @@
 package comms
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strconv"
 	"time"
-
-	"github.com/ziutek/ftdi"
 )
 
 const (
 	ID_MANUFACTURER = "ladecadence.net"
 	ID_PRODUCT      = "GB Flasher"
 	SEND_DELAY      = 50
+
+	// waits between empty reads on backends that can't block
+	POLL_MIN        = 100 * time.Microsecond
+	POLL_MAX        = 2 * time.Millisecond
 	BAUDRATE_115_2K = 115200
 	BAUDRATE_230_4K = 230400
 	BAUDRATE_1M     = 1000000
 
+	// wait between looks for a device not connected yet
+	DEVICE_POLL = 500 * time.Millisecond
+
 	// Packet types
 	TYPE_COMMAND = 0x11
 	TYPE_DATA    = 0x22
@@ -30,6 +38,8 @@ const (
 	CMD_ERASE_FLASH = 0x66
 	CMD_ERASE_RAM   = 0x77
 	CMD_READ_HEADER = 0x88
+	CMD_CONFIG      = 0x99
+	CMD_ADDRESS     = 0xAA
 	CMD_ERR         = 0xEE
 	CMD_END         = 0xFF
 )
@@ -39,95 +49,153 @@ type Packet struct {
 	Data uint8
 }
 
-type GBSDevice struct {
-	Dev *ftdi.Device
+// DeviceInfo describes an attached GBShooper.
+type DeviceInfo struct {
+	Index  int
+	Serial string
+	Path   string
 }
 
-func (gbs *GBSDevice) Open() error {
-	list, err := ftdi.FindAll(0x0403, 0x6001)
-	if err != nil {
-		return err
+// SelectDevice picks a device from list by serial number or index. An
+// empty selector is only valid when there is a single device.
+func SelectDevice(list []DeviceInfo, selector string) (DeviceInfo, error) {
+	if len(list) == 0 {
+		return DeviceInfo{}, ErrNoDevice
+	}
+	if selector == "" {
+		if len(list) > 1 {
+			return DeviceInfo{}, ErrSeveralDevices
+		}
+		return list[0], nil
 	}
-	found := false
 	for _, d := range list {
-		if d.Manufacturer == ID_MANUFACTURER && d.Description == ID_PRODUCT {
-			gbs.Dev, err = ftdi.OpenUSBDev(d, ftdi.ChannelAny)
-			if err != nil {
-				return err
-			}
-			found = true
+		if d.Serial == selector {
+			return d, nil
 		}
 	}
-	if found {
-		gbs.Dev.SetBaudrate(BAUDRATE_230_4K)
-		gbs.Dev.SetFlowControl(ftdi.FlowCtrlDisable)
-		gbs.Dev.SetLineProperties(8, 1, ftdi.ParityNone)
-		return nil
-	} else {
-		return errors.New("No device found")
+	if i, err := strconv.Atoi(selector); err == nil && i >= 0 && i < len(list) {
+		return list[i], nil
 	}
+	return DeviceInfo{}, fmt.Errorf("%w matching %s", ErrNoDevice, selector)
 }
 
-func (gbs *GBSDevice) Close() error {
-	return gbs.Dev.Close()
+// chooseDevice picks from devs the one selected as with SelectDevice, and
+// closes all the others, or all of them if none is selected.
+func chooseDevice[D any](devs []D, serial func(D) string, selector string, close func(D)) (D, DeviceInfo, error) {
+	list := []DeviceInfo{}
+	for i, d := range devs {
+		list = append(list, DeviceInfo{Index: i, Serial: serial(d)})
+	}
+	info, err := SelectDevice(list, selector)
+	var chosen D
+	for i, d := range devs {
+		if err == nil && i == info.Index {
+			chosen = d
+		} else {
+			close(d)
+		}
+	}
+	return chosen, info, err
 }
 
-func (gbs *GBSDevice) SendByte(data uint8) error {
-	err := gbs.Dev.WriteByte(data)
-	time.Sleep(time.Microsecond * SEND_DELAY)
-	return err
+// WaitDevice calls open until the device is found and free, trying every
+// DEVICE_POLL while open fails with ErrNoDevice or ErrLocked. Other errors
+// end the wait, and so does ctx, use context.WithTimeout to bound it.
+func WaitDevice(ctx context.Context, open func() (Transport, error)) (Transport, error) {
+	for {
+		gbs, err := open()
+		if !errors.Is(err, ErrNoDevice) && !errors.Is(err, ErrLocked) {
+			return gbs, err
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("%w, gave up waiting", err)
+			}
+			return nil, ctx.Err()
+		case <-time.After(DEVICE_POLL):
+		}
+	}
 }
 
-func (gbs *GBSDevice) SendPacket(packet Packet) error {
-	err := gbs.SendByte(packet.Type)
-	time.Sleep(time.Microsecond * SEND_DELAY)
-	err = gbs.SendByte(packet.Data)
-	return err
+// Transport is a link to a GBShooper able to exchange bytes and packets
+// with its firmware. GBSDevice (libftdi) is one implementation.
+type Transport interface {
+	SendByte(data uint8) error
+	SendPacket(packet Packet) error
+	SendBuffer(buffer []uint8) error
+	ReceiveByte(timeout time.Duration) (uint8, error)
+	ReceivePacket(timeout time.Duration) (Packet, error)
+	// ReceiveBuffer reads exactly len(buffer) bytes within timeout.
+	ReceiveBuffer(buffer []uint8, timeout time.Duration) error
+	Purge() error
+	Close() error
 }
 
-func (gbs *GBSDevice) ReceiveByte(timeout time.Duration) (uint8, error) {
-	var data []uint8 = make([]uint8, 1)
-
-	// timeout
-	received := false
-	for start := time.Now(); time.Since(start) < (timeout * time.Second); {
-		num, _ := gbs.Dev.Read(data)
-		if num == 1 {
-			received = true
-			break
-		}
-	}
-	if received {
-		//fmt.Printf("Byte: %x\n", data)
-		return data[0], nil
-	} else {
-		return 0, errors.New("Timeout")
-	}
+// Configurable is a Transport whose speed can be changed, so the link
+// can be sped up once both ends agree on it.
+type Configurable interface {
+	Transport
+	SetBaudrate(baudrate int) error
 }
 
-func (gbs *GBSDevice) ReceivePacket(timeout time.Duration) (Packet, error) {
-	var packet Packet
-	var data []uint8 = make([]uint8, 2)
+// port is the raw input of a backend. read returns the bytes available,
+// waiting up to timeout for the first one to arrive.
+type port interface {
+	read(data []uint8, timeout time.Duration) (int, error)
+}
 
-	remaining := 2
-	for start := time.Now(); time.Since(start) < (timeout * time.Second); {
-		num, _ := gbs.Dev.Read(data)
-		remaining -= num
-		if remaining == 0 {
-			break
+// receive fills data from p within timeout, keeping what partial reads
+// already got. A failure after some bytes is a PartialError.
+func receive(p port, data []uint8, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for received := 0; received < len(data); {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return Partial(data[:received], ErrTimeout)
+		}
+		n, err := p.read(data[received:], left)
+		if err != nil {
+			return Partial(data[:received], err)
 		}
+		received += n
 	}
+	return nil
+}
 
-	if remaining > 0 {
-		return Packet{}, errors.New("Timeout")
+func receiveByte(p port, timeout time.Duration) (uint8, error) {
+	var data []uint8 = make([]uint8, 1)
+	err := receive(p, data, timeout)
+	if err != nil {
+		return 0, err
 	}
-	packet.Type = data[0]
-	packet.Data = data[1]
+	return data[0], nil
+}
 
-	return packet, nil
+func receivePacket(p port, timeout time.Duration) (Packet, error) {
+	var data []uint8 = make([]uint8, 2)
+	err := receive(p, data, timeout)
+	if err != nil {
+		return Packet{}, err
+	}
+	return Packet{Type: data[0], Data: data[1]}, nil
 }
 
-func (gbs *GBSDevice) SendBuffer(buffer []uint8) error {
-	_, err := gbs.Dev.Write(buffer)
-	return err
+// backoffRead waits for data on a non blocking read function, sleeping
+// longer after each empty read instead of spinning.
+func backoffRead(read func([]uint8) (int, error), data []uint8, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	wait := POLL_MIN
+	for {
+		n, err := read(data)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return 0, nil
+		}
+		time.Sleep(min(wait, left))
+		wait = min(2*wait, POLL_MAX)
+	}
 }
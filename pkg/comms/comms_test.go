@@ -0,0 +1,144 @@
+package comms
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectDevice(t *testing.T) {
+	two := []DeviceInfo{{Index: 0, Serial: "GBS001"}, {Index: 1, Serial: "0"}}
+	tests := []struct {
+		name     string
+		list     []DeviceInfo
+		selector string
+		want     int
+		err      error
+	}{
+		{"none", nil, "", 0, ErrNoDevice},
+		{"single", two[:1], "", 0, nil},
+		{"ambiguous", two, "", 0, ErrSeveralDevices},
+		{"serial", two, "GBS001", 0, nil},
+		{"serial before index", two, "0", 1, nil},
+		{"index", two, "1", 1, nil},
+		{"index past the end", two, "2", 0, ErrNoDevice},
+		{"negative index", two, "-1", 0, ErrNoDevice},
+		{"unknown serial", two, "GBS002", 0, ErrNoDevice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := SelectDevice(tt.list, tt.selector)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %+v, error %v", info, err)
+				}
+				return
+			}
+			if err != nil || info != tt.list[tt.want] {
+				t.Fatalf("got %+v, error %v", info, err)
+			}
+		})
+	}
+}
+
+// TestChooseDevice checks the devices not selected are closed.
+func TestChooseDevice(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		chosen   string
+		closed   []string
+		err      error
+	}{
+		{"by serial", "B", "B", []string{"A", "C"}, nil},
+		{"by index", "2", "C", []string{"A", "B"}, nil},
+		{"ambiguous", "", "", []string{"A", "B", "C"}, ErrSeveralDevices},
+		{"missing", "D", "", []string{"A", "B", "C"}, ErrNoDevice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			closed := []string{}
+			serial := func(d string) string { return d }
+			chosen, info, err := chooseDevice([]string{"A", "B", "C"}, serial, tt.selector, func(d string) {
+				closed = append(closed, d)
+			})
+			if !errors.Is(err, tt.err) || chosen != tt.chosen {
+				t.Fatalf("chose %q, error %v", chosen, err)
+			}
+			if err == nil && info.Serial != chosen {
+				t.Fatalf("chose %q described as %+v", chosen, info)
+			}
+			if !slices.Equal(closed, tt.closed) {
+				t.Fatalf("closed %q", closed)
+			}
+		})
+	}
+}
+
+func TestWaitDevice(t *testing.T) {
+	other := errors.New("Permission denied")
+	tests := []struct {
+		name string
+		// open fails with these, then opens the device
+		fails   []error
+		timeout time.Duration
+		tries   int
+		err     error
+	}{
+		{"found", nil, 0, 1, nil},
+		{"plugged in later", []error{ErrNoDevice}, 0, 2, nil},
+		{"freed later", []error{&LockError{Key: "GBS001", PID: 1}}, 0, 2, nil},
+		{"other error", []error{other}, 0, 1, other},
+		{"gave up", []error{ErrNoDevice, ErrNoDevice, ErrNoDevice}, DEVICE_POLL + DEVICE_POLL/2, 2, ErrNoDevice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			device := &Replay{}
+			tries := 0
+			start := time.Now()
+			gbs, err := WaitDevice(ctx, func() (Transport, error) {
+				tries++
+				if tries <= len(tt.fails) {
+					return nil, tt.fails[tries-1]
+				}
+				return device, nil
+			})
+			if tries != tt.tries {
+				t.Fatalf("opened %d times", tries)
+			}
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) || gbs != nil {
+					t.Fatalf("got %v, error %v", gbs, err)
+				}
+				if tt.timeout > 0 && !strings.Contains(err.Error(), "gave up waiting") {
+					t.Fatalf("timeout reported as %v", err)
+				}
+				return
+			}
+			if err != nil || gbs != device {
+				t.Fatalf("got %v, error %v", gbs, err)
+			}
+			if waited := time.Since(start); waited < time.Duration(tries-1)*DEVICE_POLL {
+				t.Fatalf("retried after %v", waited)
+			}
+		})
+	}
+
+	// cancelled while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err := WaitDevice(ctx, func() (Transport, error) { return nil, ErrNoDevice })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v", err)
+	}
+}
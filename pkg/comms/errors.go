@@ -0,0 +1,35 @@
+package comms
+
+import "errors"
+
+// Errors returned by the transports, to be checked with errors.Is.
+var (
+	ErrNoDevice       = errors.New("No device found")
+	ErrSeveralDevices = errors.New("Several devices found, select one by serial number or index")
+	ErrTimeout        = errors.New("Timeout")
+	ErrClosed         = errors.New("Device closed")
+	ErrLocked         = errors.New("Device in use")
+)
+
+// PartialError is a failed receive which got some of the bytes asked for.
+// It reads and matches as Err.
+type PartialError struct {
+	Data []uint8
+	Err  error
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Partial wraps err with the data received before it, if any.
+func Partial(data []uint8, err error) error {
+	if len(data) == 0 {
+		return err
+	}
+	return &PartialError{Data: data, Err: err}
+}
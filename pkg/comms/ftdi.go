@@ -0,0 +1,136 @@
+//go:build cgo && !noftdi
+
+package comms
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ziutek/ftdi"
+)
+
+// OpenFTDI opens the GBShooper selected by serial number or index
+// through libftdi.
+func OpenFTDI(selector string) (Transport, error) {
+	gbs := &GBSDevice{Selector: selector}
+	err := gbs.Open()
+	if err != nil {
+		return nil, err
+	}
+	return gbs, nil
+}
+
+// ListFTDI returns the GBShoopers attached to the USB bus.
+func ListFTDI() ([]DeviceInfo, error) {
+	devs, err := findFTDI()
+	if err != nil {
+		return nil, err
+	}
+	list := []DeviceInfo{}
+	for i, d := range devs {
+		list = append(list, DeviceInfo{Index: i, Serial: d.Serial})
+		d.Close()
+	}
+	return list, nil
+}
+
+// findFTDI returns the FTDI chips identifying as a GBShooper.
+func findFTDI() ([]*ftdi.USBDev, error) {
+	all, err := ftdi.FindAll(0x0403, 0x6001)
+	if err != nil {
+		return nil, err
+	}
+	devs := []*ftdi.USBDev{}
+	for _, d := range all {
+		if d.Manufacturer == ID_MANUFACTURER && d.Description == ID_PRODUCT {
+			devs = append(devs, d)
+		} else {
+			d.Close()
+		}
+	}
+	return devs, nil
+}
+
+type GBSDevice struct {
+	Dev      *ftdi.Device
+	Selector string
+	lock     *Lock
+}
+
+// Open takes the device lock before opening the chip, see LockDevice.
+func (gbs *GBSDevice) Open() error {
+	devs, err := findFTDI()
+	if err != nil {
+		return err
+	}
+	dev, info, err := chooseDevice(devs, func(d *ftdi.USBDev) string { return d.Serial }, gbs.Selector, func(d *ftdi.USBDev) { d.Close() })
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	key := info.Serial
+	if key == "" {
+		key = "ftdi" + strconv.Itoa(info.Index)
+	}
+	gbs.lock, err = LockDevice(key)
+	if err != nil {
+		return err
+	}
+	gbs.Dev, err = ftdi.OpenUSBDev(dev, ftdi.ChannelAny)
+	if err != nil {
+		gbs.lock.Unlock()
+		return err
+	}
+
+	gbs.Dev.SetBaudrate(BAUDRATE_230_4K)
+	gbs.Dev.SetFlowControl(ftdi.FlowCtrlDisable)
+	gbs.Dev.SetLineProperties(8, 1, ftdi.ParityNone)
+	return nil
+}
+
+func (gbs *GBSDevice) SetBaudrate(baudrate int) error {
+	return gbs.Dev.SetBaudrate(baudrate)
+}
+
+func (gbs *GBSDevice) Purge() error {
+	return gbs.Dev.PurgeReadBuffer()
+}
+
+func (gbs *GBSDevice) Close() error {
+	err := gbs.Dev.Close()
+	gbs.lock.Unlock()
+	return err
+}
+
+func (gbs *GBSDevice) SendByte(data uint8) error {
+	err := gbs.Dev.WriteByte(data)
+	time.Sleep(time.Microsecond * SEND_DELAY)
+	return err
+}
+
+// SendPacket sends both bytes in a single write.
+func (gbs *GBSDevice) SendPacket(packet Packet) error {
+	return gbs.SendBuffer([]uint8{packet.Type, packet.Data})
+}
+
+func (gbs *GBSDevice) ReceiveByte(timeout time.Duration) (uint8, error) {
+	return receiveByte(gbs, timeout)
+}
+
+func (gbs *GBSDevice) ReceivePacket(timeout time.Duration) (Packet, error) {
+	return receivePacket(gbs, timeout)
+}
+
+func (gbs *GBSDevice) ReceiveBuffer(buffer []uint8, timeout time.Duration) error {
+	return receive(gbs, buffer, timeout)
+}
+
+func (gbs *GBSDevice) read(data []uint8, timeout time.Duration) (int, error) {
+	return backoffRead(gbs.Dev.Read, data, timeout)
+}
+
+func (gbs *GBSDevice) SendBuffer(buffer []uint8) error {
+	_, err := gbs.Dev.Write(buffer)
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !cgo || noftdi
+
+package comms
+
+import "errors"
+
+// OpenFTDI is not available in builds without cgo or with the noftdi tag.
+func OpenFTDI(selector string) (Transport, error) {
+	return nil, errors.New("Built without libftdi support, use the serial backend")
+}
+
+func ListFTDI() ([]DeviceInfo, error) {
+	return nil, errors.New("Built without libftdi support, use the serial backend")
+}
@@ -0,0 +1,12 @@
+//go:build !cgo || noftdi
+
+package comms
+
+import "testing"
+
+func TestListFTDIStub(t *testing.T) {
+	list, err := ListFTDI()
+	if err == nil || list != nil {
+		t.Fatalf("listed %v without libftdi", list)
+	}
+}
@@ -0,0 +1,37 @@
+package comms
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LockError reports a GBShooper held by another process. It matches
+// ErrLocked. PID is 0 if the holder could not be told.
+type LockError struct {
+	Key string
+	PID int
+}
+
+func (e *LockError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("GBShooper %s in use by another process", e.Key)
+	}
+	return fmt.Sprintf("GBShooper %s in use by process %d", e.Key, e.PID)
+}
+
+func (e *LockError) Unwrap() error {
+	return ErrLocked
+}
+
+// LockPath is the lock file of the device with key, its serial number or
+// port, in the user's runtime directory.
+func LockPath(key string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := strings.ReplaceAll(strings.TrimPrefix(key, "/"), "/", "_")
+	return filepath.Join(dir, "gbshooper-"+name+".lock")
+}
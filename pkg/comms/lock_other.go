@@ -0,0 +1,14 @@
+//go:build !unix
+
+package comms
+
+// Lock does nothing on systems without flock(2).
+type Lock struct{}
+
+func LockDevice(key string) (*Lock, error) {
+	return &Lock{}, nil
+}
+
+func (l *Lock) Unlock() error {
+	return nil
+}
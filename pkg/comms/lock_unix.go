@@ -0,0 +1,61 @@
+//go:build unix
+
+package comms
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lock is an advisory lock on a GBShooper, held while it is open so two
+// processes never talk to it at the same time. The lock file holds the
+// PID of the owner.
+type Lock struct {
+	file *os.File
+}
+
+// LockDevice takes the lock of the device with key without waiting,
+// failing with a *LockError if another process has it.
+func LockDevice(key string) (*Lock, error) {
+	path := LockPath(key)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if errors.Is(err, os.ErrPermission) {
+		// left by another user in a shared directory, it can still be
+		// locked read only, just without our PID
+		file, err = os.Open(path)
+		if err != nil {
+			return nil, &LockError{Key: key}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		data := make([]uint8, 32)
+		n, _ := file.ReadAt(data, 0)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data[:n])))
+		file.Close()
+		return nil, &LockError{Key: key, PID: pid}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	file.Truncate(0)
+	file.WriteAt([]uint8(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return &Lock{file: file}, nil
+}
+
+// Unlock releases the lock, a nil Lock is ignored.
+func (l *Lock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	return l.file.Close()
+}
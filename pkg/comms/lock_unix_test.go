@@ -0,0 +1,65 @@
+//go:build unix
+
+package comms
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestLockDevice(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	lock, err := LockDevice("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flock locks belong to the open file, so this process can't take it
+	// twice either
+	_, err = LockDevice("/dev/ttyUSB0")
+	var locked *LockError
+	if !errors.As(err, &locked) || !errors.Is(err, ErrLocked) {
+		t.Fatalf("got error %v", err)
+	}
+	if locked.PID != os.Getpid() {
+		t.Fatalf("held by %d, want %d", locked.PID, os.Getpid())
+	}
+
+	// other devices are free
+	other, err := LockDevice("/dev/ttyUSB1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Unlock()
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = LockDevice("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+}
+
+// TestLockReadOnly locks a lock file left by another user, which can't
+// be written.
+func TestLockReadOnly(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write any file")
+	}
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	if err := os.WriteFile(LockPath("/dev/ttyUSB0"), nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := LockDevice("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+	_, err = LockDevice("/dev/ttyUSB0")
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+//go:build linux
+
+package comms
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const SERIAL_GLOB = "/dev/ttyUSB*"
+
+var serialBauds = map[int]uint32{
+	BAUDRATE_115_2K: unix.B115200,
+	BAUDRATE_230_4K: unix.B230400,
+	BAUDRATE_1M:     unix.B1000000,
+}
+
+// SerialDevice talks to the GBShooper through the kernel ftdi_sio driver,
+// so it needs neither libftdi nor cgo. Any tty works, a pty included.
+type SerialDevice struct {
+	Path     string
+	Selector string
+	fd       int
+	lock     *Lock
+}
+
+// OpenSerial opens the GBShooper on a serial port. With an empty path the
+// device is chosen among the attached ones by serial number or index.
+func OpenSerial(path string, selector string) (Transport, error) {
+	gbs := &SerialDevice{Path: path, Selector: selector}
+	err := gbs.Open()
+	if err != nil {
+		return nil, err
+	}
+	return gbs, nil
+}
+
+// ListSerial returns the GBShoopers bound to the ftdi_sio driver, found
+// through the USB descriptors in sysfs.
+func ListSerial() ([]DeviceInfo, error) {
+	ports, err := filepath.Glob(SERIAL_GLOB)
+	if err != nil {
+		return nil, err
+	}
+	list := []DeviceInfo{}
+	for _, p := range ports {
+		dir, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(p), "device"))
+		if err != nil {
+			continue
+		}
+		// walk up from the tty to the USB device holding the descriptors
+		for range 3 {
+			dir = filepath.Dir(dir)
+			if sysfsAttr(dir, "manufacturer") != "" {
+				break
+			}
+		}
+		if sysfsAttr(dir, "manufacturer") != ID_MANUFACTURER || sysfsAttr(dir, "product") != ID_PRODUCT {
+			continue
+		}
+		list = append(list, DeviceInfo{Index: len(list), Serial: sysfsAttr(dir, "serial"), Path: p})
+	}
+	return list, nil
+}
+
+func sysfsAttr(dir string, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Open takes the device lock, keyed by the serial number of the
+// GBShooper or by the port for other ttys, before opening the port.
+func (gbs *SerialDevice) Open() error {
+	list, err := ListSerial()
+	if err != nil {
+		return err
+	}
+	if gbs.Path == "" {
+		info, err := SelectDevice(list, gbs.Selector)
+		if err != nil {
+			return err
+		}
+		gbs.Path = info.Path
+	}
+	key := gbs.Path
+	for _, d := range list {
+		if d.Path == gbs.Path && d.Serial != "" {
+			key = d.Serial
+		}
+	}
+
+	gbs.lock, err = LockDevice(key)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Open(gbs.Path, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOENT) {
+		err = fmt.Errorf("%w at %s", ErrNoDevice, gbs.Path)
+	}
+	if err != nil {
+		gbs.lock.Unlock()
+		return err
+	}
+	gbs.fd = fd
+
+	err = gbs.SetBaudrate(BAUDRATE_230_4K)
+	if err != nil {
+		unix.Close(fd)
+		gbs.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// SetBaudrate puts the port in raw 8N1 mode without flow control at the
+// given speed. Reads don't block, waiting is done with poll(2).
+func (gbs *SerialDevice) SetBaudrate(baudrate int) error {
+	speed, ok := serialBauds[baudrate]
+	if !ok {
+		return errors.New("Unsupported baud rate")
+	}
+	t, err := unix.IoctlGetTermios(gbs.fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+		unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.IXANY
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+	t.Ispeed = speed
+	t.Ospeed = speed
+	t.Cc[unix.VMIN] = 0
+	t.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(gbs.fd, unix.TCSETS, t)
+}
+
+func (gbs *SerialDevice) Purge() error {
+	return unix.IoctlSetInt(gbs.fd, unix.TCFLSH, unix.TCIFLUSH)
+}
+
+func (gbs *SerialDevice) Close() error {
+	err := unix.Close(gbs.fd)
+	gbs.lock.Unlock()
+	return err
+}
+
+func (gbs *SerialDevice) SendByte(data uint8) error {
+	_, err := unix.Write(gbs.fd, []uint8{data})
+	time.Sleep(time.Microsecond * SEND_DELAY)
+	return err
+}
+
+// SendPacket sends both bytes in a single write.
+func (gbs *SerialDevice) SendPacket(packet Packet) error {
+	return gbs.SendBuffer([]uint8{packet.Type, packet.Data})
+}
+
+func (gbs *SerialDevice) SendBuffer(buffer []uint8) error {
+	for len(buffer) > 0 {
+		n, err := unix.Write(gbs.fd, buffer)
+		if err != nil {
+			return err
+		}
+		buffer = buffer[n:]
+	}
+	return nil
+}
+
+func (gbs *SerialDevice) ReceiveByte(timeout time.Duration) (uint8, error) {
+	return receiveByte(gbs, timeout)
+}
+
+func (gbs *SerialDevice) ReceivePacket(timeout time.Duration) (Packet, error) {
+	return receivePacket(gbs, timeout)
+}
+
+func (gbs *SerialDevice) ReceiveBuffer(buffer []uint8, timeout time.Duration) error {
+	return receive(gbs, buffer, timeout)
+}
+
+// read blocks in poll(2) until data arrives or timeout expires.
+func (gbs *SerialDevice) read(data []uint8, timeout time.Duration) (int, error) {
+	fds := []unix.PollFd{{Fd: int32(gbs.fd), Events: unix.POLLIN}}
+	ms := int((timeout + time.Millisecond - 1) / time.Millisecond)
+	n, err := unix.Poll(fds, ms)
+	if err == unix.EINTR {
+		return 0, nil
+	}
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	return unix.Read(gbs.fd, data)
+}
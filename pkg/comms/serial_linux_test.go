@@ -0,0 +1,102 @@
+//go:build linux
+
+package comms
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pty opens a pseudo terminal pair, returning the master side and the
+// path of the slave to open as a serial port.
+func pty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("no ptys:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	err = unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestSerialPty(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	master, path := pty(t)
+
+	gbs, err := OpenSerial(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gbs.Close()
+	serial := gbs.(*SerialDevice)
+
+	for _, rate := range []int{BAUDRATE_115_2K, BAUDRATE_230_4K, BAUDRATE_1M} {
+		if err := serial.SetBaudrate(rate); err != nil {
+			t.Fatalf("set %d baud: %v", rate, err)
+		}
+	}
+	if err := serial.SetBaudrate(9600); err == nil {
+		t.Fatal("unsupported baud rate accepted")
+	}
+
+	// host to device
+	err = gbs.SendPacket(Packet{Type: TYPE_COMMAND, Data: CMD_END})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]uint8, 2)
+	master.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(master, got); err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != TYPE_COMMAND || got[1] != CMD_END {
+		t.Fatalf("device got % x", got)
+	}
+
+	// device to host, in two writes
+	want := []uint8{1, 2, 3, 4, 5, 6}
+	go func() {
+		master.Write(want[:2])
+		time.Sleep(20 * time.Millisecond)
+		master.Write(want[2:])
+	}()
+	buffer := make([]uint8, len(want))
+	if err := gbs.ReceiveBuffer(buffer, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer) != string(want) {
+		t.Fatalf("host got % x", buffer)
+	}
+
+	// nothing to read
+	start := time.Now()
+	err = gbs.ReceiveBuffer(buffer, 100*time.Millisecond)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("timed out after %v", elapsed)
+	}
+}
+
+func TestSerialMissing(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	_, err := OpenSerial(filepath.Join(t.TempDir(), "ttyUSB9"), "")
+	if !errors.Is(err, ErrNoDevice) {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package comms
+
+import "errors"
+
+// OpenSerial is only implemented on Linux.
+func OpenSerial(path string, selector string) (Transport, error) {
+	return nil, errors.New("Serial backend not supported on this system")
+}
+
+func ListSerial() ([]DeviceInfo, error) {
+	return nil, errors.New("Serial backend not supported on this system")
+}
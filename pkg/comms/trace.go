@@ -0,0 +1,271 @@
+package comms
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trace files are text, one event per line: seconds since the start, a
+// direction and the bytes in hex.
+//
+//	0.000000 > 44 00
+//	0.001187 < 44 17 44 31 44 30
+//	3.002741 ! Timeout
+//
+// ">" is sent by the host, "<" received from the device and "!" a failed
+// receive, after the bytes it got if any. Purges and speed changes are written as "purge" and
+// "baud N". Lines starting with # are comments.
+const TRACE_HEADER = "# GBShooper trace v1"
+
+// Tracer is a Transport recording all the traffic of another one.
+type Tracer struct {
+	Transport Transport
+	w         io.Writer
+	start     time.Time
+}
+
+// NewTracer records the traffic of gbs on w. w is closed with the Tracer
+// when it is an io.Closer.
+func NewTracer(gbs Transport, w io.Writer) *Tracer {
+	t := &Tracer{Transport: gbs, w: w, start: time.Now()}
+	fmt.Fprintln(w, TRACE_HEADER)
+	return t
+}
+
+func (t *Tracer) record(dir string, data string) {
+	line := fmt.Sprintf("%.6f %s", time.Since(t.start).Seconds(), dir)
+	if data != "" {
+		line += " " + data
+	}
+	fmt.Fprintln(t.w, line)
+}
+
+func (t *Tracer) sent(data []uint8) {
+	t.record(">", fmt.Sprintf("% x", data))
+}
+
+func (t *Tracer) received(data []uint8, err error) {
+	var short *PartialError
+	if errors.As(err, &short) {
+		t.record("<", fmt.Sprintf("% x", short.Data))
+	}
+	if err != nil {
+		t.record("!", err.Error())
+		return
+	}
+	t.record("<", fmt.Sprintf("% x", data))
+}
+
+func (t *Tracer) SendByte(data uint8) error {
+	t.sent([]uint8{data})
+	return t.Transport.SendByte(data)
+}
+
+func (t *Tracer) SendPacket(packet Packet) error {
+	t.sent([]uint8{packet.Type, packet.Data})
+	return t.Transport.SendPacket(packet)
+}
+
+func (t *Tracer) SendBuffer(buffer []uint8) error {
+	t.sent(buffer)
+	return t.Transport.SendBuffer(buffer)
+}
+
+func (t *Tracer) ReceiveByte(timeout time.Duration) (uint8, error) {
+	data, err := t.Transport.ReceiveByte(timeout)
+	t.received([]uint8{data}, err)
+	return data, err
+}
+
+func (t *Tracer) ReceivePacket(timeout time.Duration) (Packet, error) {
+	packet, err := t.Transport.ReceivePacket(timeout)
+	t.received([]uint8{packet.Type, packet.Data}, err)
+	return packet, err
+}
+
+func (t *Tracer) ReceiveBuffer(buffer []uint8, timeout time.Duration) error {
+	err := t.Transport.ReceiveBuffer(buffer, timeout)
+	t.received(buffer, err)
+	return err
+}
+
+func (t *Tracer) Purge() error {
+	t.record("purge", "")
+	return t.Transport.Purge()
+}
+
+func (t *Tracer) Close() error {
+	err := t.Transport.Close()
+	if c, ok := t.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// SetBaudrate changes the speed of the traced Transport, if it can.
+func (t *Tracer) SetBaudrate(baudrate int) error {
+	t.record("baud", strconv.Itoa(baudrate))
+	gbs, ok := t.Transport.(Configurable)
+	if !ok {
+		return errors.New("Can't change the speed of this device")
+	}
+	return gbs.SetBaudrate(baudrate)
+}
+
+// Replay is a Transport playing back a trace: it answers with the bytes
+// the device sent, in the same order, and checks the host sends what was
+// recorded. Timings are not reproduced, failed receives are.
+type Replay struct {
+	// device output, a segment with err is a failed receive
+	out []segment
+	// expected host output
+	in   []uint8
+	sent int
+}
+
+type segment struct {
+	data []uint8
+	err  error
+}
+
+// ErrTraceEnd is returned when the host goes past the recorded traffic.
+var ErrTraceEnd = errors.New("End of trace")
+
+// ReplayError reports the host sending something else than recorded.
+type ReplayError struct {
+	Offset   int
+	Expected uint8
+	Actual   uint8
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("Replay diverged at sent byte %d: expected 0x%02x, got 0x%02x", e.Offset, e.Expected, e.Actual)
+}
+
+// OpenReplay reads a trace written by a Tracer.
+func OpenReplay(r io.Reader) (*Replay, error) {
+	rp := &Replay{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Bad trace line %d: %s", line, text)
+		}
+		rest := ""
+		if len(fields) == 3 {
+			rest = fields[2]
+		}
+		switch fields[1] {
+		case ">", "<":
+			data, err := hex.DecodeString(strings.ReplaceAll(rest, " ", ""))
+			if err != nil {
+				return nil, fmt.Errorf("Bad trace line %d: %w", line, err)
+			}
+			if fields[1] == ">" {
+				rp.in = append(rp.in, data...)
+			} else {
+				rp.out = append(rp.out, segment{data: data})
+			}
+		case "!":
+			rp.out = append(rp.out, segment{err: traceError(rest)})
+		case "purge", "baud":
+		default:
+			return nil, fmt.Errorf("Bad trace line %d: %s", line, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// traceError turns a recorded error back into the comms one, if any.
+func traceError(text string) error {
+	for _, err := range []error{ErrTimeout, ErrClosed} {
+		if text == err.Error() {
+			return err
+		}
+	}
+	return errors.New(text)
+}
+
+func (rp *Replay) SendByte(data uint8) error {
+	return rp.SendBuffer([]uint8{data})
+}
+
+func (rp *Replay) SendPacket(packet Packet) error {
+	return rp.SendBuffer([]uint8{packet.Type, packet.Data})
+}
+
+func (rp *Replay) SendBuffer(buffer []uint8) error {
+	for _, b := range buffer {
+		if rp.sent >= len(rp.in) {
+			return ErrTraceEnd
+		}
+		if rp.in[rp.sent] != b {
+			return &ReplayError{Offset: rp.sent, Expected: rp.in[rp.sent], Actual: b}
+		}
+		rp.sent++
+	}
+	return nil
+}
+
+func (rp *Replay) ReceiveByte(timeout time.Duration) (uint8, error) {
+	var data []uint8 = make([]uint8, 1)
+	err := rp.ReceiveBuffer(data, timeout)
+	return data[0], err
+}
+
+func (rp *Replay) ReceivePacket(timeout time.Duration) (Packet, error) {
+	var data []uint8 = make([]uint8, 2)
+	err := rp.ReceiveBuffer(data, timeout)
+	return Packet{Type: data[0], Data: data[1]}, err
+}
+
+// ReceiveBuffer hands out the recorded device output. A recorded failure
+// is returned when it is next in line, as a PartialError after the bytes
+// recorded before it.
+func (rp *Replay) ReceiveBuffer(buffer []uint8, timeout time.Duration) error {
+	for received := 0; received < len(buffer); {
+		if len(rp.out) == 0 {
+			return ErrTraceEnd
+		}
+		seg := &rp.out[0]
+		if seg.err != nil {
+			rp.out = rp.out[1:]
+			return Partial(buffer[:received], seg.err)
+		}
+		n := copy(buffer[received:], seg.data)
+		seg.data = seg.data[n:]
+		received += n
+		if len(seg.data) == 0 {
+			rp.out = rp.out[1:]
+		}
+	}
+	return nil
+}
+
+func (rp *Replay) Purge() error {
+	return nil
+}
+
+func (rp *Replay) Close() error {
+	return nil
+}
+
+func (rp *Replay) SetBaudrate(baudrate int) error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package flashcart
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the flashcart operations, to be checked with
+// errors.Is. Transport failures come from pkg/comms, like comms.ErrTimeout.
+var (
+	ErrBadID         = errors.New("Bad GBShooper ID")
+	ErrDeviceError   = errors.New("Device error")
+	ErrDeviceTimeout = errors.New("Device timeout")
+	ErrNoCart        = errors.New("No cart detected")
+	ErrEmptyFile     = errors.New("Empty file")
+	ErrUnknownSize   = errors.New("Unknown size in cart header")
+	ErrNoAddress     = errors.New("Firmware can't start a transfer at an address")
+	ErrUnknownChip   = errors.New("Unknown flash chip")
+	ErrOutOfRange    = errors.New("Past the end of the flash chip")
+	ErrNotErased     = errors.New("Flash not erased")
+)
+
+// ChecksumError reports a chunk whose checksum did not match. When
+// writing, Expected is the checksum of the data sent and Actual the one
+// echoed by the device. When reading, the device only tells the checksum
+// sent by the host was wrong, so Read is set and Actual is not known.
+// Attempts is how many times the chunk was transferred.
+type ChecksumError struct {
+	Chunk    int64
+	Expected uint16
+	Actual   uint16
+	Read     bool
+	Attempts int
+}
+
+func (e *ChecksumError) Error() string {
+	msg := fmt.Sprintf("Bad checksum in chunk %d: expected 0x%02x, got 0x%02x", e.Chunk, e.Expected, e.Actual)
+	if e.Read {
+		msg = fmt.Sprintf("Bad checksum in chunk %d: device rejected 0x%02x", e.Chunk, e.Expected)
+	}
+	if e.Attempts > 1 {
+		msg += fmt.Sprintf(" after %d attempts", e.Attempts)
+	}
+	return msg
+}
+
+// ImageCRCError reports a transfer whose CRC32 of all the chunks,
+// Expected as computed by the host, differs from the one computed by the
+// device.
+type ImageCRCError struct {
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ImageCRCError) Error() string {
+	return fmt.Sprintf("Bad image CRC32: expected 0x%08x, got 0x%08x", e.Expected, e.Actual)
+}
+
+// StatusError reports a status packet other than STAT_OK. It matches
+// ErrDeviceError or ErrDeviceTimeout for STAT_ERROR and STAT_TIMEOUT.
+type StatusError struct {
+	Op     string
+	Status uint8
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Problem with hardware, can't %s (status 0x%02x)", e.Op, e.Status)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch e.Status {
+	case STAT_ERROR:
+		return ErrDeviceError
+	case STAT_TIMEOUT:
+		return ErrDeviceTimeout
+	}
+	return nil
+}
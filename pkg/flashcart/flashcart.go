@@ -1,28 +1,36 @@
 package flashcart
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"os"
 	"slices"
+	"strings"
+	"time"
 
 	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/protocol"
 )
 
 const (
-	GBS_ID      = 0x17 // 23 decimal
-	SLEEPTIME   = 3
-	ERASETIME   = 60
+	GBS_ID      = protocol.GBS_ID
+	SLEEPTIME   = 3 * time.Second
+	ERASETIME   = 60 * time.Second
 	BUFFER_SIZE = 256
+	// cart type, ROM size, RAM size and the 16 byte title
+	HEADER_SIZE = 19
+	// wait between header reads while waiting for a cart
+	CART_POLL = 500 * time.Millisecond
 
 	// status
-	STAT_OK      = 0x14 // 10.4 ;-)
-	STAT_ERROR   = 0xEE
-	STAT_TIMEOUT = 0xAA
+	STAT_OK      = protocol.STAT_OK
+	STAT_ERROR   = protocol.STAT_ERROR
+	STAT_TIMEOUT = protocol.STAT_TIMEOUT
+	STAT_RETRY   = protocol.STAT_RETRY
 
 	// Sizes
 	S_0K    = 0
+	S_512   = 512
 	S_2K    = 2048
 	S_8K    = 8192
 	S_32K   = 32768
@@ -48,6 +56,7 @@ type FlashID struct {
 	ChipID         uint8
 	Manufacturer   string
 	Chip           string
+	Size           int
 }
 
 type RomHeader struct {
@@ -70,6 +79,7 @@ type FlashProducer struct {
 type FlashNames struct {
 	ID   uint8
 	Name string
+	Size int
 }
 
 type CartType struct {
@@ -105,7 +115,7 @@ var FlashProducers = []FlashProducer{
 
 // flash chip IDs
 var ChipIDs = []FlashNames{
-	{0xA4, "29F040B"}, {0xAD, "AM29F016"},
+	{0xA4, "29F040B", S_512K}, {0xAD, "AM29F016", S_2MB},
 }
 
 // Cartridge types
@@ -135,82 +145,73 @@ var ROMSizes = []ROMSize{
 
 // RAM sizes
 var RAMSizes = []RAMSize{
-	{0x00, "0KB", S_0K}, {0x01, "2KB", S_2K}, {0x02, "8KB", S_2K},
+	{0x00, "0KB", S_0K}, {0x01, "2KB", S_2K}, {0x02, "8KB", S_8K},
 	{0x03, "32KB", S_32K}, {0x04, "128KB", S_128K},
 }
 
-func GBSStatus() (Status, error) {
+func (s *Session) Status(ctx context.Context) (Status, error) {
 	status := Status{}
-	gbs := comms.GBSDevice{}
-	err := gbs.Open()
+	c, err := s.begin(ctx)
 	if err != nil {
 		return Status{}, err
 	}
-	defer gbs.Close()
-	gbs.Dev.PurgeReadBuffer()
 
-	// create packet
-	packet := comms.Packet{Type: comms.TYPE_INFO, Data: 0x00}
-	// send it
-	gbs.SendPacket(packet)
+	// send handshake
+	err = c.Send(protocol.Info{Data: 0x00})
+	if err != nil {
+		return Status{}, err
+	}
 
-	// read answer (3 packets)
-	packet, err = gbs.ReceivePacket(SLEEPTIME)
+	// read answer (3 packets), the id first
+	msg, err := c.Receive(s.timeout())
+	var seq *protocol.SequenceError
+	if errors.As(err, &seq) {
+		packet := msg.Encode()
+		return Status{}, fmt.Errorf("%w: type 0x%02x, id 0x%02x", ErrBadID, packet[0], packet[1])
+	}
 	if err != nil {
 		return Status{}, err
 	}
-	id := packet.Data
-	ty := packet.Type
-	packet, err = gbs.ReceivePacket(SLEEPTIME)
+	id := msg.(protocol.Info).Data
+	status.VersionMayor, err = c.ReceiveInfo(s.timeout())
 	if err != nil {
 		return Status{}, err
 	}
-	status.VersionMayor = packet.Data
-	packet, err = gbs.ReceivePacket(SLEEPTIME)
+	status.VersionMinor, err = c.ReceiveInfo(s.timeout())
 	if err != nil {
 		return Status{}, err
 	}
-	status.VersionMinor = packet.Data
 
 	// checks
 	if id != GBS_ID {
-		fmt.Printf("Type: %x\n", ty)
-		fmt.Printf("ID: %x\n", id)
-		return Status{}, errors.New("Bad GBShooper ID")
+		return Status{}, fmt.Errorf("%w: type 0x%02x, id 0x%02x", ErrBadID, comms.TYPE_INFO, id)
 	}
 
 	// ok
 	return status, nil
 }
 
-func GBSChipID() (FlashID, error) {
+func (s *Session) ChipID(ctx context.Context) (FlashID, error) {
 	id := FlashID{}
-	gbs := comms.GBSDevice{}
-	err := gbs.Open()
+	c, err := s.begin(ctx)
 	if err != nil {
 		return FlashID{}, err
 	}
-	defer gbs.Close()
-	gbs.Dev.PurgeReadBuffer()
 
-	// create packet
-	packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_ID}
-	// send it
-	gbs.SendPacket(packet)
+	err = c.Send(protocol.Command{Command: comms.CMD_ID})
+	if err != nil {
+		return FlashID{}, err
+	}
 
 	// read answer (2 packets)
-	packet, err = gbs.ReceivePacket(SLEEPTIME)
+	id.ManufacturerID, err = c.ReceiveData(s.timeout())
 	if err != nil {
 		return FlashID{}, err
 	}
-
-	id.ManufacturerID = packet.Data
-
-	packet, err = gbs.ReceivePacket(SLEEPTIME)
+	id.ChipID, err = c.ReceiveData(s.timeout())
 	if err != nil {
 		return FlashID{}, err
 	}
-	id.ChipID = packet.Data
 
 	if idx := slices.IndexFunc(FlashProducers, func(c FlashProducer) bool { return c.ID == id.ManufacturerID }); idx != -1 {
 		id.Manufacturer = FlashProducers[idx].Name
@@ -220,6 +221,7 @@ func GBSChipID() (FlashID, error) {
 
 	if idx := slices.IndexFunc(ChipIDs, func(c FlashNames) bool { return c.ID == id.ChipID }); idx != -1 {
 		id.Chip = ChipIDs[idx].Name
+		id.Size = ChipIDs[idx].Size
 	} else {
 		id.Chip = fmt.Sprintf("Unknown Flash chip: 0x%0x", id.ChipID)
 	}
@@ -228,51 +230,47 @@ func GBSChipID() (FlashID, error) {
 	return id, nil
 }
 
-func GBSReadHeader() (RomHeader, error) {
-	header := RomHeader{}
-	gbs := comms.GBSDevice{}
-	err := gbs.Open()
+func (s *Session) ReadHeader(ctx context.Context) (RomHeader, error) {
+	c, err := s.begin(ctx)
 	if err != nil {
 		return RomHeader{}, err
 	}
-	defer gbs.Close()
-	gbs.Dev.PurgeReadBuffer()
-
-	// create packet
-	packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_READ_HEADER}
-	// send it
-	gbs.SendPacket(packet)
 
-	// read answer ( first 3 packets)
-	// pkt1 = mapper, pkt2 = rom size, pkt3 = ram_size
-	packet, err = gbs.ReceivePacket(SLEEPTIME)
+	err = c.Send(protocol.Command{Command: comms.CMD_READ_HEADER})
 	if err != nil {
 		return RomHeader{}, err
 	}
-	header.CartType = packet.Data
 
-	packet, err = gbs.ReceivePacket(SLEEPTIME)
-	if err != nil {
-		return RomHeader{}, err
+	// read answer
+	data := make([]uint8, HEADER_SIZE)
+	for i := range data {
+		data[i], err = c.ReceiveData(s.timeout())
+		if err != nil {
+			return RomHeader{}, err
+		}
 	}
-	header.ROMSize = packet.Data
+	return ParseHeader(data)
+}
 
-	packet, err = gbs.ReceivePacket(SLEEPTIME)
-	if err != nil {
-		return RomHeader{}, err
+// ParseHeader decodes the answer to CMD_READ_HEADER: cart type, ROM size
+// and RAM size codes followed by the 16 title bytes. Unknown codes are
+// reported in the names, not as errors.
+func ParseHeader(data []uint8) (RomHeader, error) {
+	header := RomHeader{}
+	if len(data) != HEADER_SIZE {
+		return RomHeader{}, fmt.Errorf("Bad header length %d", len(data))
 	}
-	header.RAMSize = packet.Data
 
-	// now read cart name (16 bytes)
-	for range 16 {
-		packet, err = gbs.ReceivePacket(SLEEPTIME)
-		if err != nil {
-			return RomHeader{}, err
-		}
-		header.Title += string(packet.Data)
+	// pkt1 = mapper, pkt2 = rom size, pkt3 = ram_size
+	header.CartType = data[0]
+	header.ROMSize = data[1]
+	header.RAMSize = data[2]
+
+	// now cart name (16 bytes)
+	for _, b := range data[3:] {
+		header.Title += string(b)
 	}
 
-	// fill types
 	// fill types
 	if idx := slices.IndexFunc(CartTypes, func(c CartType) bool { return c.ID == header.CartType }); idx != -1 {
 		header.Cart = CartTypes[idx].Type
@@ -301,460 +299,195 @@ func GBSReadHeader() (RomHeader, error) {
 	return header, nil
 }
 
-func GBSEraseFlash() error {
-	gbs := comms.GBSDevice{}
-	err := gbs.Open()
-	if err != nil {
-		return err
+// Valid tells whether the header was read from a cart: known cart type and
+// ROM size, and some printable title. Without a cart, or with dirty
+// contacts, the lines read all 0xFF or all 0x00.
+func (h RomHeader) Valid() bool {
+	if h.Cart == "Unknown cart type" || h.ROMBytes == 0 {
+		return false
 	}
-	defer gbs.Close()
-	gbs.Dev.PurgeReadBuffer()
+	for _, r := range h.Title {
+		if r > ' ' && r < 0x7f {
+			return true
+		}
+	}
+	return false
+}
 
-	// create packet
-	packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_ERASE_FLASH}
-	// send it
-	gbs.SendPacket(packet)
+// carts with save RAM not told by their name
+var ramCarts = []uint8{0x1f, 0xfe}
 
-	// read answer
-	packet, err = gbs.ReceivePacket(ERASETIME)
-	if err != nil {
-		return err
+// MBC2 carts have 512 half bytes of RAM built in, and no RAM size code
+var mbc2Carts = []uint8{0x05, 0x06}
+
+// ROMDumpSize is the size of the ROM told by the header. It fails with
+// ErrUnknownSize if the header is not valid or the size doesn't fit the
+// cart type.
+func (h RomHeader) ROMDumpSize() (int64, error) {
+	if !h.Valid() {
+		return 0, fmt.Errorf("%w: no valid header", ErrUnknownSize)
 	}
-	if packet.Data == STAT_OK {
-		return nil
-	} else {
-		return errors.New("Error erasing flash")
+	if h.CartType == 0x00 && h.ROMBytes != S_32K {
+		return 0, fmt.Errorf("%w: %s cart with %s of ROM", ErrUnknownSize, h.Cart, h.ROM)
 	}
+	return int64(h.ROMBytes), nil
 }
 
-func GBSWriteFlash(filename string, finished chan bool, progress chan int64, errchan chan error) error {
-	// finishing
-	defer func() { finished <- true }()
-
-	// open rom file
-	rom, err := os.Open(filename)
-	if err != nil {
-		errchan <- err
-		return err
+// RAMDumpSize is the size of the save RAM told by the header, like
+// ROMDumpSize.
+func (h RomHeader) RAMDumpSize() (int64, error) {
+	if !h.Valid() {
+		return 0, fmt.Errorf("%w: no valid header", ErrUnknownSize)
 	}
-	defer rom.Close()
-
-	// get file size
-	stats, err := rom.Stat()
-	if err != nil {
-		errchan <- err
-		return err
+	if slices.Contains(mbc2Carts, h.CartType) {
+		return S_512, nil
 	}
-	romSize := stats.Size()
-
-	// open GBShooper
-	gbs := comms.GBSDevice{}
-	err = gbs.Open()
-	if err != nil {
-		errchan <- err
-		return err
+	if h.RAM == "Unknown RAM size" {
+		return 0, fmt.Errorf("%w: RAM size code 0x%02x", ErrUnknownSize, h.RAMSize)
 	}
-	defer gbs.Close()
-	gbs.Dev.PurgeReadBuffer()
-
-	// and start writing
-	var chunkCounter int64 = 0
-	buffer := make([]byte, BUFFER_SIZE)
-
-	// create packet
-	packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_PRG_FLASH}
-	// send it
-	gbs.SendPacket(packet)
-
-	stat, err := gbs.ReceivePacket(SLEEPTIME)
-	if err != nil {
-		packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-		// send it
-		gbs.SendPacket(packet)
-		errchan <- err
-		return err
+	ram := strings.Contains(h.Cart, "RAM") || slices.Contains(ramCarts, h.CartType)
+	if ram != (h.RAMBytes > 0) {
+		return 0, fmt.Errorf("%w: %s cart with %s of RAM", ErrUnknownSize, h.Cart, h.RAM)
 	}
-	if stat.Data == STAT_OK {
-		for {
-			// calculate percentage
-			percent := (100 * chunkCounter * BUFFER_SIZE) / romSize
-			progress <- percent
-
-			// read a chunk
-			_, err := rom.Read(buffer)
-			if err != nil {
-				// end?
-				if err == io.EOF {
-					break
-				}
-
-			}
-			// checksum
-			var check uint8 = 0
-			for i := range BUFFER_SIZE {
-				check += buffer[i]
-			}
-
-			// send the data
-			err = gbs.SendBuffer(buffer)
-			// get answer
-			stat, err := gbs.ReceivePacket(SLEEPTIME)
-			// checksum correct?
-			if stat.Data != check {
-				packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-				// send it
-				gbs.SendPacket(packet)
-				errchan <- errors.New("Bad checksum")
-				return errors.New("Bad checksum")
-			}
+	return int64(h.RAMBytes), nil
+}
 
-			// EOF?
-			c := make([]uint8, 1)
-			_, err = rom.Read(c)
-			if err != io.EOF {
-				// ok, keep writing
-				rom.Seek(-1, 1)
-				packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_PRG_FLASH}
-				// send it
-				gbs.SendPacket(packet)
-				chunkCounter++
+// WaitCart reads the header every CART_POLL until a cart is detected, or
+// ctx ends.
+func (s *Session) WaitCart(ctx context.Context) (RomHeader, error) {
+	for {
+		header, err := s.ReadHeader(ctx)
+		if err != nil || header.Valid() {
+			return header, err
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return header, fmt.Errorf("%w, gave up waiting", ErrNoCart)
 			}
-
+			return header, ctx.Err()
+		case <-time.After(CART_POLL):
 		}
-	} else {
-		packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-		// send it
-		gbs.SendPacket(packet)
-		errchan <- errors.New("Problem with hardware, can't write to Flash")
-		return errors.New("Problem with hardware, can't write to Flash")
 	}
-
-	// end
-	packet = comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-	// send it
-	gbs.SendPacket(packet)
-	return nil
 }
 
-func GBSReadFlash(filename string, size int64, finished chan bool, progress chan int64, errchan chan error) error {
-	// finishing
-	defer func() { finished <- true }()
-
-	// open rom file
-	rom, err := os.Create(filename)
+func (s *Session) EraseFlash(ctx context.Context) error {
+	c, err := s.begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer rom.Close()
 
-	// open GBShooper
-	gbs := comms.GBSDevice{}
-	err = gbs.Open()
+	err = c.Send(protocol.Command{Command: comms.CMD_ERASE_FLASH})
 	if err != nil {
 		return err
 	}
-	defer gbs.Close()
-	gbs.Dev.PurgeReadBuffer()
-
-	// start reading
-	chunks := size / BUFFER_SIZE
-	buffer := make([]byte, BUFFER_SIZE)
-	packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_READ_FLASH}
-	// send it
-	gbs.SendPacket(packet)
-
-	for n := range chunks {
-		// calculate progress
-		percent := n * BUFFER_SIZE * 100 / size
-		progress <- percent
 
-		// read buffer and calculate checksum
-		var check uint8 = 0
-		for i := range BUFFER_SIZE {
-			buffer[i], err = gbs.ReceiveByte(SLEEPTIME)
-			if err != nil {
-				errchan <- err
-				return err
-			}
-			check += buffer[i]
-		}
-		// write buffer in file
-		rom.Write(buffer)
-
-		// send checksum
-		packet = comms.Packet{Type: comms.TYPE_DATA, Data: check}
-		gbs.SendPacket(packet)
-
-		// read answer
-		stat, err := gbs.ReceivePacket(SLEEPTIME)
-		if err != nil {
-			errchan <- err
-			return err
+	// read answer, checking for cancellation every second
+	var stat uint8
+	for start := time.Now(); time.Since(start) < ERASETIME; {
+		stat, err = c.ReceiveStat(time.Second)
+		if ctx.Err() != nil {
+			c.Abort()
+			return ctx.Err()
 		}
-		// cheksum bad?
-		if stat.Data == comms.CMD_END {
-			errchan <- errors.New("Bad checksum")
-			return errors.New("Bad checksum")
+		if !errors.Is(err, comms.ErrTimeout) {
+			break
 		}
-
-		// ok, continue
-		if n < chunks-1 {
-			packet = comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_READ_FLASH}
-			gbs.SendPacket(packet)
-		}
-	}
-
-	// finished
-	packet = comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-	gbs.SendPacket(packet)
-
-	finished <- true
-	return nil
-}
-
-func GBSWriteRAM(filename string, finished chan bool, progress chan int64) error {
-	// finishing
-	defer func() { finished <- true }()
-
-	// open RAM file
-	ram, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer ram.Close()
-
-	// get file size
-	stats, err := ram.Stat()
-	if err != nil {
-		return err
 	}
-	romSize := stats.Size()
-
-	// open GBShooper
-	gbs := comms.GBSDevice{}
-	err = gbs.Open()
 	if err != nil {
 		return err
 	}
-	defer gbs.Close()
-	gbs.Dev.PurgeReadBuffer()
-
-	// and start writing
-	var chunkCounter int64 = 0
-	buffer := make([]byte, BUFFER_SIZE)
-
-	// create packet
-	packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_PRG_RAM}
-	// send it
-	gbs.SendPacket(packet)
-
-	stat, err := gbs.ReceivePacket(SLEEPTIME)
-	if err != nil {
-		packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-		// send it
-		gbs.SendPacket(packet)
-		return err
+	if stat == STAT_OK {
+		return nil
+	} else {
+		return &StatusError{Op: "erase flash", Status: stat}
 	}
-	if stat.Data == STAT_OK {
-		for {
-			// calculate percentage
-			percent := (100 * chunkCounter * BUFFER_SIZE) / romSize
-			progress <- percent
+}
 
-			// read a chunk
-			_, err := ram.Read(buffer)
-			if err != nil {
-				// end?
-				if err == io.EOF {
-					break
-				}
+func (s *Session) WriteFlash(ctx context.Context, filename string, finished chan bool, progress chan int64, errchan chan error) error {
+	return s.write(ctx, comms.CMD_PRG_FLASH, "write to Flash", filename, 0, finished, progress, errchan)
+}
 
-			}
-			// checksum
-			var check uint8 = 0
-			for i := range BUFFER_SIZE {
-				check += buffer[i]
-			}
+func (s *Session) ReadFlash(ctx context.Context, filename string, size int64, finished chan bool, progress chan int64, errchan chan error) error {
+	return s.read(ctx, comms.CMD_READ_FLASH, "read Flash", filename, 0, size, finished, progress, errchan)
+}
 
-			// send the data
-			err = gbs.SendBuffer(buffer)
-			// get answer
-			stat, err := gbs.ReceivePacket(SLEEPTIME)
-			// checksum correct?
-			if stat.Data != check {
-				packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-				// send it
-				gbs.SendPacket(packet)
-				return errors.New("Bad checksum")
-			}
+// ReadFlashRange reads size bytes of flash from offset on, which needs
+// FEATURE_ADDRESS unless offset is 0.
+func (s *Session) ReadFlashRange(ctx context.Context, filename string, offset int64, size int64, finished chan bool, progress chan int64, errchan chan error) error {
+	return s.read(ctx, comms.CMD_READ_FLASH, "read Flash", filename, offset, size, finished, progress, errchan)
+}
 
-			// EOF?
-			c := make([]uint8, 1)
-			_, err = ram.Read(c)
-			if err != io.EOF {
-				// ok, keep writing
-				ram.Seek(-1, 1)
-				packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_PRG_RAM}
-				// send it
-				gbs.SendPacket(packet)
-				chunkCounter++
-			}
+func (s *Session) WriteRAM(ctx context.Context, filename string, finished chan bool, progress chan int64, errchan chan error) error {
+	return s.write(ctx, comms.CMD_PRG_RAM, "write to RAM", filename, 0, finished, progress, errchan)
+}
 
-		}
-	} else {
-		packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-		// send it
-		gbs.SendPacket(packet)
-		return errors.New("Problem with hardware, can't write to RAM")
-	}
+func (s *Session) ReadRAM(ctx context.Context, filename string, size int64, finished chan bool, progress chan int64, errchan chan error) error {
+	return s.read(ctx, comms.CMD_READ_RAM, "read RAM", filename, 0, size, finished, progress, errchan)
+}
 
-	// end
-	packet = comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-	// send it
-	gbs.SendPacket(packet)
-	return nil
+// ReadRAMRange is ReadFlashRange for the save RAM.
+func (s *Session) ReadRAMRange(ctx context.Context, filename string, offset int64, size int64, finished chan bool, progress chan int64, errchan chan error) error {
+	return s.read(ctx, comms.CMD_READ_RAM, "read RAM", filename, offset, size, finished, progress, errchan)
 }
 
-func GBSReadRAM(filename string, size int64, finished chan bool, progress chan int64, errchan chan error) error {
+func (s *Session) EraseRAM(ctx context.Context, size int64, finished chan bool, progress chan int64, errchan chan error) error {
 	// finishing
 	defer func() { finished <- true }()
 
-	// open rom file
-	rom, err := os.Create(filename)
+	c, err := s.begin(ctx)
 	if err != nil {
-		return err
+		return fail(errchan, err)
 	}
-	defer rom.Close()
 
-	// open GBShooper
-	gbs := comms.GBSDevice{}
-	err = gbs.Open()
+	// and start erasing, the device answers with an acknowledge and then
+	// once for every chunk erased
+	chunks := size / BUFFER_SIZE
+	err = c.Send(protocol.Command{Command: comms.CMD_ERASE_RAM})
 	if err != nil {
-		return err
+		return fail(errchan, err)
+	}
+	stat, err := c.ReceiveStat(s.timeout())
+	if err != nil {
+		c.Abort()
+		return fail(errchan, err)
+	}
+	if stat != STAT_OK {
+		c.Abort()
+		return fail(errchan, &StatusError{Op: "erase RAM", Status: stat})
 	}
-	defer gbs.Close()
-	gbs.Dev.PurgeReadBuffer()
-
-	// start reading
-	chunks := size / BUFFER_SIZE
-	buffer := make([]byte, BUFFER_SIZE)
-	packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_READ_RAM}
-	// send it
-	gbs.SendPacket(packet)
 
 	for n := range chunks {
-		// calculate progress
-		percent := n * BUFFER_SIZE * 100 / size
+		// calculate percentage
+		percent := (100 * n * BUFFER_SIZE) / size
 		progress <- percent
 
-		// read buffer and calculate checksum
-		var check uint8 = 0
-		for i := range BUFFER_SIZE {
-			buffer[i], err = gbs.ReceiveByte(SLEEPTIME)
-			if err != nil {
-				errchan <- err
-				return err
-			}
-			check += buffer[i]
+		// cancelled?
+		if ctx.Err() != nil {
+			c.Abort()
+			return fail(errchan, ctx.Err())
 		}
-		// write buffer in file
-		rom.Write(buffer)
-
-		// send checksum
-		packet = comms.Packet{Type: comms.TYPE_DATA, Data: check}
-		gbs.SendPacket(packet)
 
-		// read answer
-		stat, err := gbs.ReceivePacket(SLEEPTIME)
+		// get answer
+		stat, err := c.ReceiveStat(s.timeout())
 		if err != nil {
-			errchan <- err
-			return err
+			c.Abort()
+			return fail(errchan, err)
 		}
-		// cheksum bad?
-		if stat.Data == comms.CMD_END {
-			errchan <- errors.New("Bad checksum")
-			return errors.New("Bad checksum")
+		// ok?
+		if stat != STAT_OK {
+			c.Abort()
+			return fail(errchan, &StatusError{Op: "erase RAM", Status: stat})
 		}
 
-		// ok, continue
-		if n < chunks-1 {
-			packet = comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_READ_RAM}
-			gbs.SendPacket(packet)
-		}
-	}
-
-	// finished
-	packet = comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-	gbs.SendPacket(packet)
-
-	finished <- true
-	return nil
-}
-
-func GBSEraseRAM(size int64, finished chan bool, progress chan int64, errchan chan error) error {
-	// finishing
-	defer func() { finished <- true }()
-
-	// open GBShooper
-	gbs := comms.GBSDevice{}
-	err := gbs.Open()
-	if err != nil {
-		errchan <- err
-		return err
-	}
-	defer gbs.Close()
-	gbs.Dev.PurgeReadBuffer()
-
-	// and start erasing
-	var chunkCounter int64 = 0
-
-	// create packet
-	packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_ERASE_RAM}
-	// send it
-	gbs.SendPacket(packet)
-
-	stat, err := gbs.ReceivePacket(SLEEPTIME)
-	if err != nil {
-		packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-		// send it
-		gbs.SendPacket(packet)
-		errchan <- err
-		return err
-	}
-	if stat.Data == STAT_OK {
-		for range size / BUFFER_SIZE {
-			// calculate percentage
-			percent := (100 * chunkCounter * BUFFER_SIZE) / size
-			progress <- percent
-
-			// get answer
-			stat, _ := gbs.ReceivePacket(SLEEPTIME)
-			// ok?
-			if stat.Data != STAT_OK {
-				packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-				// send it
-				gbs.SendPacket(packet)
-				errchan <- errors.New("Error erasing")
-				return errors.New("Error erasing")
-			}
-
-			// continue
-			packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_ERASE_RAM}
-			// send it
-			gbs.SendPacket(packet)
-			chunkCounter++
+		// continue
+		err = c.Send(protocol.Command{Command: comms.CMD_ERASE_RAM})
+		if err != nil {
+			c.Abort()
+			return fail(errchan, err)
 		}
-	} else {
-		packet := comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-		// send it
-		gbs.SendPacket(packet)
-		errchan <- errors.New("Problem with hardware, can't erase RAM")
-		return errors.New("Problem with hardware, can't erase RAM")
 	}
 
 	// end
-	packet = comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END}
-	// send it
-	gbs.SendPacket(packet)
-	return nil
+	return fail(errchan, c.Send(protocol.Command{Command: comms.CMD_END}))
 }
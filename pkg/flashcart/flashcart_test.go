@@ -0,0 +1,96 @@
+package flashcart
+
+import (
+	"errors"
+	"testing"
+	"unicode/utf8"
+)
+
+func FuzzParseHeader(f *testing.F) {
+	f.Add([]uint8("\x1b\x05\x03POKEMON RED\x00\x00\x00\x00\x00"))
+	f.Add([]uint8("\x00\x00\x00TETRIS\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+	f.Add([]uint8("\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"))
+	f.Add([]uint8("\x19\x52"))
+	f.Fuzz(func(t *testing.T, data []uint8) {
+		header, err := ParseHeader(data)
+		if len(data) != HEADER_SIZE {
+			if err == nil {
+				t.Fatalf("%d bytes parsed as a header", len(data))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.CartType != data[0] || header.ROMSize != data[1] || header.RAMSize != data[2] {
+			t.Fatalf("codes % x parsed as %02x %02x %02x", data[:3], header.CartType, header.ROMSize, header.RAMSize)
+		}
+		if n := utf8.RuneCountInString(header.Title); n != 16 {
+			t.Fatalf("title %q has %d characters", header.Title, n)
+		}
+		if header.Cart == "" || header.ROM == "" || header.RAM == "" {
+			t.Fatalf("unnamed types in %+v", header)
+		}
+		if (header.ROM == "Unknown ROM size") != (header.ROMBytes == 0) {
+			t.Fatalf("ROM size %q of %d bytes", header.ROM, header.ROMBytes)
+		}
+		if header.RAM == "Unknown RAM size" && header.RAMBytes != 0 {
+			t.Fatalf("RAM size %q of %d bytes", header.RAM, header.RAMBytes)
+		}
+	})
+}
+
+// TestDumpSize checks the sizes told by headers, -1 standing for
+// ErrUnknownSize.
+func TestDumpSize(t *testing.T) {
+	title := "TITLE\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	tests := []struct {
+		name   string
+		header string
+		rom    int64
+		ram    int64
+	}{
+		{"ROM only", "\x00\x00\x00" + title, S_32K, 0},
+		{"ROM only too large", "\x00\x01\x00" + title, -1, 0},
+		{"MBC1 without RAM", "\x01\x05\x00" + title, S_1MB, 0},
+		{"MBC1 8KB RAM", "\x03\x04\x02" + title, S_512K, S_8K},
+		{"MBC5 32KB RAM", "\x1b\x06\x03" + title, S_2MB, S_32K},
+		{"MBC2", "\x06\x03\x00" + title, S_256K, S_512},
+		{"MBC2 with a RAM size", "\x05\x03\x02" + title, S_256K, S_512},
+		{"Pocket Camera", "\x1f\x05\x04" + title, S_1MB, S_128K},
+		{"RAM size without RAM", "\x01\x05\x02" + title, S_1MB, -1},
+		{"RAM without a size", "\x1b\x05\x00" + title, S_1MB, -1},
+		{"unknown RAM size", "\x1b\x06\x07" + title, S_2MB, -1},
+		{"unknown ROM size", "\x19\x09\x00" + title, -1, -1},
+		{"unknown cart type", "\x42\x00\x00" + title, -1, -1},
+		{"no cart", "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff", -1, -1},
+		{"blank title", "\x03\x04\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", -1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := ParseHeader([]uint8(tt.header))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, size := range []struct {
+				name string
+				dump func() (int64, error)
+				want int64
+			}{
+				{"ROM", header.ROMDumpSize, tt.rom},
+				{"RAM", header.RAMDumpSize, tt.ram},
+			} {
+				got, err := size.dump()
+				if size.want == -1 {
+					if !errors.Is(err, ErrUnknownSize) {
+						t.Fatalf("%s size %d, error %v", size.name, got, err)
+					}
+					continue
+				}
+				if err != nil || got != size.want {
+					t.Fatalf("%s size %d, error %v, want %d", size.name, got, err, size.want)
+				}
+			}
+		})
+	}
+}
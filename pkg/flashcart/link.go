@@ -0,0 +1,257 @@
+package flashcart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/protocol"
+)
+
+const (
+	// link every GBShooper starts with
+	DEFAULT_BAUDRATE = comms.BAUDRATE_230_4K
+	MAX_CHUNK_SIZE   = 4096
+	// time for the device to change its speed
+	SWITCHTIME = 20 * time.Millisecond
+
+	// protocol features in the CMD_CONFIG bitmask
+	FEATURE_RETRY   = protocol.FEATURE_RETRY
+	FEATURE_CRC16   = protocol.FEATURE_CRC16
+	FEATURE_CRC32   = protocol.FEATURE_CRC32
+	FEATURE_ADDRESS = protocol.FEATURE_ADDRESS
+	// features this client knows how to use
+	FEATURES = FEATURE_RETRY | FEATURE_CRC16 | FEATURE_CRC32 | FEATURE_ADDRESS
+)
+
+// first firmware version answering CMD_CONFIG
+var CONFIG_VERSION = Status{'1', '1'}
+
+// Link is the baud rate, transfer chunk size and enabled protocol
+// features of a Session.
+type Link struct {
+	Baudrate  int
+	ChunkSize int
+	Features  uint8
+}
+
+// DefaultLink is what old units, and new ones before negotiation, use.
+var DefaultLink = Link{DEFAULT_BAUDRATE, BUFFER_SIZE, 0}
+
+// Capabilities are the baud rates, the largest chunk and the protocol
+// features a firmware supports, as reported by CMD_CONFIG.
+type Capabilities struct {
+	Baudrates []int
+	MaxChunk  int
+	Features  uint8
+}
+
+type Baudrate struct {
+	ID   uint8
+	Rate int
+}
+
+// baud rates in the CMD_CONFIG bitmask
+var Baudrates = []Baudrate{
+	{0x01, comms.BAUDRATE_115_2K}, {0x02, comms.BAUDRATE_230_4K},
+	{0x04, comms.BAUDRATE_1M},
+}
+
+// AtLeast reports whether the hardware version is v or newer.
+func (st Status) AtLeast(v Status) bool {
+	if st.VersionMayor != v.VersionMayor {
+		return st.VersionMayor > v.VersionMayor
+	}
+	return st.VersionMinor >= v.VersionMinor
+}
+
+func (s *Session) linkOrDefault() Link {
+	if s.Link == (Link{}) {
+		return DefaultLink
+	}
+	return s.Link
+}
+
+func (s *Session) chunkSize() int {
+	return s.linkOrDefault().ChunkSize
+}
+
+func (s *Session) feature(f uint8) bool {
+	return s.Link.Features&f != 0
+}
+
+// Negotiate switches the session to the fastest baud rate, the largest
+// chunk size and the protocol features both ends support. Units older
+// than CONFIG_VERSION, and transports which can't change speed, stay on
+// DefaultLink. So does a unit not answering on the faster link, which is
+// put back on DefaultLink; only when that fails is an error returned.
+func (s *Session) Negotiate(ctx context.Context) (Link, error) {
+	_, ok := s.Transport.(comms.Configurable)
+	if !ok || !s.Version.AtLeast(CONFIG_VERSION) {
+		s.Link = DefaultLink
+		return s.Link, nil
+	}
+
+	caps, err := s.Capabilities(ctx)
+	if err != nil {
+		return s.Link, err
+	}
+
+	link := DefaultLink
+	for _, rate := range caps.Baudrates {
+		link.Baudrate = max(link.Baudrate, rate)
+	}
+	for size := BUFFER_SIZE; size <= min(caps.MaxChunk, MAX_CHUNK_SIZE); size *= 2 {
+		link.ChunkSize = size
+	}
+	link.Features = caps.Features & FEATURES
+	if link == DefaultLink {
+		s.Link = link
+		return s.Link, nil
+	}
+	err = s.SetLink(ctx, link)
+	if err == nil {
+		return s.Link, nil
+	}
+	ferr := s.fallback(ctx, link)
+	if ferr != nil {
+		return s.Link, fmt.Errorf("%w, and no answer on the default link: %w", err, ferr)
+	}
+	return s.Link, nil
+}
+
+// fallback brings back to DefaultLink a device which may have been left
+// on link by a failed SetLink: it may not have switched, it may answer a
+// CMD_CONFIG on link, or else it is looked for with GBSRecover.
+func (s *Session) fallback(ctx context.Context, link Link) error {
+	gbs := s.Transport.(comms.Configurable)
+	s.Link = DefaultLink
+	gbs.SetBaudrate(DEFAULT_BAUDRATE)
+	c, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// end a configuration left halfway
+	c.Abort()
+	if _, err = s.Status(ctx); err == nil {
+		return nil
+	}
+
+	s.Link = link
+	err = gbs.SetBaudrate(link.Baudrate)
+	if err == nil {
+		err = s.SetLink(ctx, DefaultLink)
+	}
+	s.Link = DefaultLink
+	if err == nil {
+		return nil
+	}
+	_, err = GBSRecover(ctx, s.Transport)
+	return err
+}
+
+// Capabilities asks the firmware which baud rates and chunk sizes it
+// supports, leaving the link as it is.
+func (s *Session) Capabilities(ctx context.Context) (Capabilities, error) {
+	c, caps, err := s.config(ctx)
+	if c != nil {
+		// leave configuration
+		c.Send(protocol.Command{Command: comms.CMD_END})
+	}
+	return caps, err
+}
+
+// SetLink changes the link of the device and then the speed of the
+// transport, checking the device still answers at the new speed. If it
+// doesn't, the transport goes back to the old speed but the device may
+// be left on the new link, not answering: Negotiate puts it back on
+// DefaultLink, and GBSRecover looks for it at every speed.
+func (s *Session) SetLink(ctx context.Context, link Link) error {
+	gbs, ok := s.Transport.(comms.Configurable)
+	if !ok {
+		return fmt.Errorf("Can't change the speed of this device")
+	}
+	var id uint8
+	for _, b := range Baudrates {
+		if b.Rate == link.Baudrate {
+			id = b.ID
+		}
+	}
+	if id == 0 || link.ChunkSize%BUFFER_SIZE != 0 || link.ChunkSize > MAX_CHUNK_SIZE || link.Features&^FEATURES != 0 {
+		return fmt.Errorf("Unsupported link: %d baud, %d byte chunks, features 0x%02x", link.Baudrate, link.ChunkSize, link.Features)
+	}
+
+	c, _, err := s.config(ctx)
+	if err != nil {
+		return err
+	}
+	// send baud rate, chunk size in 256 byte units and features
+	err = c.Send(protocol.Data{Data: id},
+		protocol.Data{Data: uint8(link.ChunkSize / BUFFER_SIZE)},
+		protocol.Data{Data: link.Features})
+	if err != nil {
+		return err
+	}
+	stat, err := c.ReceiveStat(s.timeout())
+	if err != nil {
+		return err
+	}
+	if stat != STAT_OK {
+		return &StatusError{Op: "configure link", Status: stat}
+	}
+
+	// follow the device
+	time.Sleep(SWITCHTIME)
+	err = gbs.SetBaudrate(link.Baudrate)
+	if err != nil {
+		return err
+	}
+	gbs.Purge()
+	_, err = s.Status(ctx)
+	if err != nil {
+		gbs.SetBaudrate(s.linkOrDefault().Baudrate)
+		return fmt.Errorf("No answer at %d baud: %w", link.Baudrate, err)
+	}
+	s.Link = link
+	return nil
+}
+
+// config starts a CMD_CONFIG exchange and reads the capabilities. Older
+// firmware answers with a status instead.
+func (s *Session) config(ctx context.Context) (*protocol.Conn, Capabilities, error) {
+	caps := Capabilities{}
+	c, err := s.begin(ctx)
+	if err != nil {
+		return nil, caps, err
+	}
+
+	err = c.Send(protocol.Command{Command: comms.CMD_CONFIG})
+	if err != nil {
+		return nil, caps, err
+	}
+	var values [3]uint8
+	for i := range values {
+		values[i], err = c.ReceiveData(s.timeout())
+		var seq *protocol.SequenceError
+		if errors.As(err, &seq) {
+			if stat, ok := seq.Message.(protocol.Stat); ok {
+				err = &StatusError{Op: "configure link", Status: stat.Status}
+			}
+		}
+		if err != nil {
+			return c, caps, err
+		}
+	}
+	bauds, chunk, features := values[0], values[1], values[2]
+
+	for _, b := range Baudrates {
+		if bauds&b.ID != 0 {
+			caps.Baudrates = append(caps.Baudrates, b.Rate)
+		}
+	}
+	caps.MaxChunk = int(chunk) * BUFFER_SIZE
+	caps.Features = features
+	return c, caps, nil
+}
@@ -0,0 +1,79 @@
+package flashcart
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+)
+
+// WriteFlashAt programs filename in the flash from offset on, leaving the
+// rest of it as it is. The range has to fit in the flash chip and read
+// erased, as flash can only be erased whole. Needs FEATURE_ADDRESS
+// unless offset is 0.
+func (s *Session) WriteFlashAt(ctx context.Context, filename string, offset int64, finished chan bool, progress chan int64, errchan chan error) error {
+	// finishing
+	defer func() { finished <- true }()
+
+	err := s.checkRange(ctx, filename, offset, progress)
+	if err != nil {
+		return fail(errchan, err)
+	}
+	return fail(errchan, s.program(ctx, comms.CMD_PRG_FLASH, "write to Flash", filename, offset, progress))
+}
+
+// checkRange checks the flash chip has room for filename at offset and
+// that the range to program reads erased.
+func (s *Session) checkRange(ctx context.Context, filename string, offset int64, progress chan int64) error {
+	stats, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	size := stats.Size()
+	if size == 0 {
+		return fmt.Errorf("%w: %s", ErrEmptyFile, filename)
+	}
+
+	id, err := s.ChipID(ctx)
+	if err != nil {
+		return err
+	}
+	if id.Size == 0 {
+		return fmt.Errorf("%w (0x%02x), can't tell its size", ErrUnknownChip, id.ChipID)
+	}
+	if offset < 0 || offset+size > int64(id.Size) {
+		return fmt.Errorf("%w: 0x%06x-0x%06x in a %d byte %s", ErrOutOfRange, offset, offset+size-1, id.Size, id.Chip)
+	}
+
+	blank := &blankChecker{addr: offset, first: -1}
+	err = s.readTo(ctx, comms.CMD_READ_FLASH, "check erased", blank, offset, size, progress)
+	if err != nil {
+		return err
+	}
+	if blank.count > 0 {
+		return fmt.Errorf("%w: %d bytes from 0x%06x on", ErrNotErased, blank.count, blank.first)
+	}
+	return nil
+}
+
+// blankChecker is an io.Writer counting the bytes which aren't erased
+// flash.
+type blankChecker struct {
+	addr  int64
+	first int64
+	count int64
+}
+
+func (b *blankChecker) Write(data []uint8) (int, error) {
+	for i, v := range data {
+		if v != 0xFF {
+			if b.first < 0 {
+				b.first = b.addr + int64(i)
+			}
+			b.count++
+		}
+	}
+	b.addr += int64(len(data))
+	return len(data), nil
+}
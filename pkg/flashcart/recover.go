@@ -0,0 +1,166 @@
+package flashcart
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+)
+
+const (
+	// rounds of CMD_END bursts before giving up
+	RECOVER_ATTEMPTS = 4
+	// how long to wait for stale output and for the handshake
+	RECOVER_WAIT = 100 * time.Millisecond
+)
+
+// Recovery tells what GBSRecover had to do to get the device back.
+type Recovery struct {
+	// Drained is how many stale bytes the device had sent.
+	Drained int
+	// Ends is how many CMD_END packets were sent.
+	Ends int
+	// Attempts is how many rounds it took, 1 if the device was idle.
+	Attempts int
+	// Baudrate the device was found at.
+	Baudrate int
+	// Realigned is set when the device had half a packet pending.
+	Realigned bool
+	// LinkReset is set when the device was put back on DefaultLink.
+	LinkReset bool
+	// Committed is set when the device had a chunk half received, which
+	// was completed with the handshake and 0xFF and echoed. The device programs it, unless
+	// it waits for a verdict (FEATURE_RETRY).
+	Committed bool
+	Version   Status
+}
+
+// GBSRecover brings back a device left in the middle of a transfer by a
+// previous run. It drains the stale output and tries the handshake. A
+// device not answering at all may have a chunk half received, which is
+// completed with 0xFF. Then CMD_END is sent until the command is ended
+// and the handshake retried. Devices left on a negotiated speed are looked
+// for at every known baud rate and put back on DefaultLink.
+func GBSRecover(ctx context.Context, gbs comms.Transport) (Recovery, error) {
+	rec := Recovery{}
+	s := &Session{Transport: gbs, Timeout: RECOVER_WAIT}
+
+	bauds := []int{DEFAULT_BAUDRATE}
+	link, configurable := gbs.(comms.Configurable)
+	if configurable {
+		for i := len(Baudrates) - 1; i >= 0; i-- {
+			if Baudrates[i].Rate != DEFAULT_BAUDRATE {
+				bauds = append(bauds, Baudrates[i].Rate)
+			}
+		}
+	}
+
+	ends := 2
+	burst := make([]uint8, 0, 1+2*ends)
+	for range ends {
+		burst = append(burst, comms.TYPE_COMMAND, comms.CMD_END)
+	}
+
+	var status Status
+	var err error
+	filled := map[int]bool{}
+	for rec.Attempts = 1; rec.Attempts <= RECOVER_ATTEMPTS; rec.Attempts++ {
+		for _, baud := range bauds {
+			if ctx.Err() != nil {
+				return rec, ctx.Err()
+			}
+			if configurable {
+				link.SetBaudrate(baud)
+			}
+
+			// maybe the device is fine
+			rec.Realigned = false
+			rec.Drained += len(drain(gbs))
+			status, err = s.Status(ctx)
+			if err == nil {
+				rec.Version = status
+				rec.Baudrate = baud
+				return rec, resetLink(ctx, s, &rec)
+			}
+			if errors.Is(err, context.Canceled) {
+				return rec, err
+			}
+
+			// a half received chunk takes in the handshake silently, and
+			// would take the CMD_END packets too
+			out := drain(gbs)
+			rec.Drained += len(out)
+			if len(out) == 0 && !filled[baud] {
+				filled[baud] = true
+				rec.Committed = fill(gbs) || rec.Committed
+			}
+
+			// every other round an odd byte completes a pending half
+			// packet
+			data := burst
+			rec.Realigned = rec.Attempts%2 == 0
+			if rec.Realigned {
+				data = append([]uint8{comms.CMD_END}, burst...)
+			}
+			gbs.SendBuffer(data)
+			rec.Ends += ends
+			time.Sleep(RECOVER_WAIT)
+			rec.Drained += len(drain(gbs))
+
+			status, err = s.Status(ctx)
+			if err == nil {
+				rec.Version = status
+				rec.Baudrate = baud
+				return rec, resetLink(ctx, s, &rec)
+			}
+		}
+	}
+	if configurable {
+		link.SetBaudrate(DEFAULT_BAUDRATE)
+	}
+	return rec, fmt.Errorf("Device not recovered after %d attempts: %w", RECOVER_ATTEMPTS, err)
+}
+
+// resetLink puts a device found on another speed back on DefaultLink.
+func resetLink(ctx context.Context, s *Session, rec *Recovery) error {
+	if rec.Baudrate == DEFAULT_BAUDRATE {
+		return nil
+	}
+	s.Version = rec.Version
+	s.Link = Link{Baudrate: rec.Baudrate}
+	err := s.SetLink(ctx, DefaultLink)
+	if err != nil {
+		return err
+	}
+	rec.LinkReset = true
+	return nil
+}
+
+// fill completes a chunk the device may have half received with 0xFF,
+// which leaves the flash cells as they are, a BUFFER_SIZE block at a time
+// until the device answers. It tells if the answer was the echo of the
+// chunk.
+func fill(gbs comms.Transport) bool {
+	block := bytes.Repeat([]uint8{0xFF}, BUFFER_SIZE)
+	for sent := 0; sent < MAX_CHUNK_SIZE; sent += BUFFER_SIZE {
+		gbs.SendBuffer(block)
+		if out := drain(gbs); len(out) > 0 {
+			return out[0] == comms.TYPE_DATA
+		}
+	}
+	return false
+}
+
+// drain reads what the device sends until it goes quiet.
+func drain(gbs comms.Transport) []uint8 {
+	out := []uint8{}
+	buffer := make([]uint8, 1)
+	for gbs.ReceiveBuffer(buffer, RECOVER_WAIT) == nil {
+		out = append(out, buffer[0])
+	}
+	gbs.Purge()
+	return out
+}
@@ -0,0 +1,28 @@
+package flashcart
+
+import (
+	"context"
+	"time"
+)
+
+// RetryPolicy says how many times a chunk with a bad checksum is
+// transferred again before giving up, and how long to wait first. The
+// wait doubles after each attempt.
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+var DefaultRetry = RetryPolicy{Attempts: 3, Backoff: 10 * time.Millisecond}
+
+// backoff waits before retry number attempt, counting from 1.
+func (s *Session) backoff(ctx context.Context, attempt int) error {
+	wait := time.NewTimer(s.Retry.Backoff << (attempt - 1))
+	defer wait.Stop()
+	select {
+	case <-wait.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,130 @@
+package flashcart
+
+import (
+	"context"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/protocol"
+)
+
+// Session is an open connection to a GBShooper. NewSession checks the
+// hardware once and then every operation runs over the same Transport.
+type Session struct {
+	Transport comms.Transport
+	Version   Status
+	// Link is the negotiated speed and chunk size, DefaultLink if zero.
+	Link Link
+	// Timeout is how long to wait for each answer, SLEEPTIME if zero.
+	Timeout time.Duration
+	// Retry is applied to chunks with a bad checksum.
+	Retry RetryPolicy
+	// Verify makes writes read the cart back and compare it with the
+	// file, failing with a *VerifyError.
+	Verify bool
+	// Retries counts the chunks sent again in the last transfer.
+	Retries int
+	// CRC32 of the image of the last transfer, the same as the file's,
+	// and whether the device agreed on the chunks transferred
+	// (FEATURE_CRC32).
+	CRC32        uint32
+	CRC32Checked bool
+
+	conn *protocol.Conn
+}
+
+// NewSession performs the TYPE_INFO handshake on gbs, failing if the
+// other end is not a GBShooper, and negotiates the fastest link.
+func NewSession(ctx context.Context, gbs comms.Transport) (*Session, error) {
+	s := &Session{Transport: gbs, Retry: DefaultRetry}
+	status, err := s.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.Version = status
+	_, err = s.Negotiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return SLEEPTIME
+}
+
+// begin starts a command exchange on the Transport: pending answers are
+// dropped and the protocol machine goes back to Idle, following the
+// features of the link.
+func (s *Session) begin(ctx context.Context) (*protocol.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.conn == nil {
+		s.conn = protocol.NewConn(s.Transport)
+	}
+	s.Transport.Purge()
+	s.conn.Reset()
+	s.conn.Features = s.Link.Features
+	return s.conn, nil
+}
+
+// Close puts the device back on DefaultLink, so the next connection finds
+// it there, and closes the underlying Transport.
+func (s *Session) Close() error {
+	if s.linkOrDefault() != DefaultLink {
+		s.SetLink(context.Background(), DefaultLink)
+	}
+	return s.Transport.Close()
+}
+
+// The GBS* functions run a single operation on gbs without a handshake,
+// on the default link and with DefaultRetry. On cancellation of ctx,
+// running transfers are ended and ctx.Err() is returned.
+
+func GBSStatus(ctx context.Context, gbs comms.Transport) (Status, error) {
+	return (&Session{Transport: gbs}).Status(ctx)
+}
+
+func GBSChipID(ctx context.Context, gbs comms.Transport) (FlashID, error) {
+	return (&Session{Transport: gbs}).ChipID(ctx)
+}
+
+func GBSReadHeader(ctx context.Context, gbs comms.Transport) (RomHeader, error) {
+	return (&Session{Transport: gbs}).ReadHeader(ctx)
+}
+
+func GBSEraseFlash(ctx context.Context, gbs comms.Transport) error {
+	return (&Session{Transport: gbs}).EraseFlash(ctx)
+}
+
+func GBSWriteFlash(ctx context.Context, gbs comms.Transport, filename string, finished chan bool, progress chan int64, errchan chan error) error {
+	return (&Session{Transport: gbs, Retry: DefaultRetry}).WriteFlash(ctx, filename, finished, progress, errchan)
+}
+
+func GBSReadFlash(ctx context.Context, gbs comms.Transport, filename string, size int64, finished chan bool, progress chan int64, errchan chan error) error {
+	return (&Session{Transport: gbs, Retry: DefaultRetry}).ReadFlash(ctx, filename, size, finished, progress, errchan)
+}
+
+func GBSWriteRAM(ctx context.Context, gbs comms.Transport, filename string, finished chan bool, progress chan int64, errchan chan error) error {
+	return (&Session{Transport: gbs, Retry: DefaultRetry}).WriteRAM(ctx, filename, finished, progress, errchan)
+}
+
+func GBSReadRAM(ctx context.Context, gbs comms.Transport, filename string, size int64, finished chan bool, progress chan int64, errchan chan error) error {
+	return (&Session{Transport: gbs, Retry: DefaultRetry}).ReadRAM(ctx, filename, size, finished, progress, errchan)
+}
+
+func GBSEraseRAM(ctx context.Context, gbs comms.Transport, size int64, finished chan bool, progress chan int64, errchan chan error) error {
+	return (&Session{Transport: gbs}).EraseRAM(ctx, size, finished, progress, errchan)
+}
+
+func GBSCompareFlash(ctx context.Context, gbs comms.Transport, filename string, finished chan bool, progress chan int64, errchan chan error) (Comparison, error) {
+	return (&Session{Transport: gbs, Retry: DefaultRetry}).CompareFlash(ctx, filename, finished, progress, errchan)
+}
+
+func GBSCompareRAM(ctx context.Context, gbs comms.Transport, filename string, finished chan bool, progress chan int64, errchan chan error) (Comparison, error) {
+	return (&Session{Transport: gbs, Retry: DefaultRetry}).CompareRAM(ctx, filename, finished, progress, errchan)
+}
@@ -0,0 +1,529 @@
+package flashcart
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/protocol"
+)
+
+// buffers in flight between the file and the device
+const PIPELINE_DEPTH = 4
+
+// write programs the contents of filename from offset on with command
+// (CMD_PRG_FLASH or CMD_PRG_RAM).
+func (s *Session) write(ctx context.Context, command uint8, op string, filename string, offset int64, finished chan bool, progress chan int64, errchan chan error) error {
+	// finishing
+	defer func() { finished <- true }()
+	return fail(errchan, s.program(ctx, command, op, filename, offset, progress))
+}
+
+// program is write without the channels. The file is read ahead in
+// another goroutine, and each chunk goes to the device in a single write
+// together with its command.
+func (s *Session) program(ctx context.Context, command uint8, op string, filename string, offset int64, progress chan int64) error {
+	// open file
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// get file size, the last chunk is padded
+	stats, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stats.Size()
+	// the device would wait forever for a first chunk
+	if size == 0 {
+		return fmt.Errorf("%w: %s", ErrEmptyFile, filename)
+	}
+
+	// the padding is programmed too, and past the end of a RAM smaller
+	// than the chunk it wraps over the start: sizes which aren't a whole
+	// number of chunks go in BUFFER_SIZE chunks, as on DefaultLink
+	if size%int64(s.chunkSize()) != 0 && s.chunkSize() != BUFFER_SIZE {
+		link := s.Link
+		small := link
+		small.ChunkSize = BUFFER_SIZE
+		err = s.SetLink(ctx, small)
+		if err != nil {
+			return err
+		}
+		defer s.SetLink(context.Background(), link)
+	}
+	chunk := int64(s.chunkSize())
+	chunks := (size + chunk - 1) / chunk
+
+	c, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.seek(c, offset)
+	if err != nil {
+		return err
+	}
+
+	// start writing
+	err = c.Send(protocol.Command{Command: command})
+	if err != nil {
+		return err
+	}
+	stat, err := c.ReceiveStat(s.timeout())
+	if err != nil {
+		c.Abort()
+		return err
+	}
+	if stat != STAT_OK {
+		c.Abort()
+		return &StatusError{Op: op, Status: stat}
+	}
+
+	reader := newChunkReader(file, chunks, chunk)
+	defer reader.close()
+	msgs := make([]protocol.Message, 0, 3)
+
+	// with FEATURE_RETRY the device waits for a verdict on each echoed
+	// checksum, which goes out with the next command
+	retry := s.feature(FEATURE_RETRY)
+	var verdict []protocol.Message
+	var buffer []uint8
+	attempts := 0
+	s.Retries = 0
+	s.CRC32, s.CRC32Checked = 0, false
+	kind := s.check()
+	// the device's CRC32 covers the padding too, the image one doesn't
+	var crc, image uint32 = 0, 0
+
+	for n := int64(0); n < chunks; {
+		// calculate percentage
+		progress <- n * chunk * 100 / size
+
+		if attempts == 0 {
+			buffer, err = reader.next()
+			if err != nil {
+				c.Abort()
+				return err
+			}
+		}
+		check := kind.Compute(buffer)
+
+		// the first chunk follows the command already sent, the next
+		// ones go with their own command, resent ones with none
+		msgs = append(msgs[:0], verdict...)
+		if n > 0 || attempts > 0 {
+			// cancelled?
+			if ctx.Err() != nil {
+				c.Abort()
+				return ctx.Err()
+			}
+		}
+		if n > 0 && attempts == 0 {
+			msgs = append(msgs, protocol.Command{Command: command})
+		}
+		msgs = append(msgs, protocol.Chunk{Data: buffer})
+
+		// send the data
+		err = c.Send(msgs...)
+		if err != nil {
+			c.Abort()
+			return err
+		}
+		// get answer
+		echo, err := c.ReceiveCheck(kind, s.timeout())
+		if err != nil {
+			c.Abort()
+			return err
+		}
+		// checksum correct?
+		if echo != check {
+			attempts++
+			if !retry || attempts > s.Retry.Attempts {
+				c.Abort()
+				return &ChecksumError{Chunk: n, Expected: check, Actual: echo, Attempts: attempts}
+			}
+			s.Retries++
+			err = s.backoff(ctx, attempts)
+			if err != nil {
+				c.Abort()
+				return err
+			}
+			verdict = []protocol.Message{protocol.Stat{Status: STAT_RETRY}}
+			continue
+		}
+
+		crc = comms.UpdateCRC32(crc, buffer)
+		image = comms.UpdateCRC32(image, buffer[:min(chunk, size-n*chunk)])
+		reader.release(buffer)
+		if retry {
+			verdict = []protocol.Message{protocol.Stat{Status: STAT_OK}}
+		}
+		attempts = 0
+		n++
+	}
+
+	// end
+	err = c.Send(append(verdict, protocol.Command{Command: comms.CMD_END})...)
+	if err != nil {
+		return err
+	}
+	err = s.imageCRC(c, crc, image)
+	if err == nil && s.Verify {
+		err = s.verify(ctx, command, filename, offset, progress)
+	}
+	return err
+}
+
+// read dumps size bytes from offset into filename with command
+// (CMD_READ_FLASH or CMD_READ_RAM).
+func (s *Session) read(ctx context.Context, command uint8, op string, filename string, offset int64, size int64, finished chan bool, progress chan int64, errchan chan error) error {
+	// finishing
+	defer func() { finished <- true }()
+
+	// open file
+	file, err := os.Create(filename)
+	if err != nil {
+		return fail(errchan, err)
+	}
+	defer file.Close()
+	return fail(errchan, s.readTo(ctx, command, op, file, offset, size, progress))
+}
+
+// readTo reads size bytes from offset with command and hands them to w.
+// Chunks are passed to w by another goroutine while the next one is
+// transferred.
+func (s *Session) readTo(ctx context.Context, command uint8, op string, w io.Writer, offset int64, size int64, progress chan int64) error {
+	chunk := int64(s.chunkSize())
+	writer := newChunkWriter(w, chunk)
+	defer writer.close()
+	// the device sends a chunk as soon as it gets the command
+	if size <= 0 {
+		return writer.close()
+	}
+
+	c, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.seek(c, offset)
+	if err != nil {
+		return err
+	}
+
+	// start reading, the last chunk may be cut
+	chunks := (size + chunk - 1) / chunk
+	err = c.Send(protocol.Command{Command: command})
+	if err != nil {
+		return err
+	}
+
+	// with FEATURE_RETRY the device keeps its place on a bad checksum
+	// and sends the chunk again, older firmware ends the read, which is
+	// started over skipping the chunks already written
+	retry := s.feature(FEATURE_RETRY)
+	var written int64 = 0
+	attempts := 0
+	s.Retries = 0
+	s.CRC32, s.CRC32Checked = 0, false
+	kind := s.check()
+	// the device's CRC32 covers the whole last chunk, the image one
+	// doesn't
+	var crc, image uint32 = 0, 0
+
+	for n := int64(0); n < chunks; {
+		// calculate progress
+		progress <- n * chunk * 100 / size
+
+		// cancelled?
+		if ctx.Err() != nil {
+			c.Abort()
+			return ctx.Err()
+		}
+
+		// read buffer and calculate checksum
+		buffer := writer.buffer()
+		err = c.ReceiveChunk(buffer, s.timeout())
+		if err != nil {
+			c.Abort()
+			return err
+		}
+		check := kind.Compute(buffer)
+
+		// send checksum
+		err = c.Send(protocol.CheckData(kind, check)...)
+		if err != nil {
+			c.Abort()
+			return err
+		}
+
+		// read answer
+		stat, err := c.ReceiveStat(s.timeout())
+		if err != nil {
+			c.Abort()
+			return err
+		}
+		// cheksum bad?
+		if stat == comms.CMD_END || stat == STAT_RETRY {
+			writer.discard(buffer)
+			attempts++
+			if attempts > s.Retry.Attempts {
+				c.Abort()
+				return &ChecksumError{Chunk: n, Expected: check, Read: true, Attempts: attempts}
+			}
+			s.Retries++
+			err = s.backoff(ctx, attempts)
+			if err != nil {
+				c.Abort()
+				return err
+			}
+			if !retry || stat == comms.CMD_END {
+				written = max(written, n)
+				n = 0
+				crc, image = 0, 0
+				err = s.seek(c, offset)
+				if err != nil {
+					c.Abort()
+					return err
+				}
+			}
+			err = c.Send(protocol.Command{Command: command})
+			if err != nil {
+				c.Abort()
+				return err
+			}
+			continue
+		}
+		if stat != STAT_OK {
+			c.Abort()
+			return &StatusError{Op: op, Status: stat}
+		}
+		crc = comms.UpdateCRC32(crc, buffer)
+		image = comms.UpdateCRC32(image, buffer[:min(chunk, size-n*chunk)])
+		// attempts count until a chunk not read before gets through
+		if n >= written {
+			writer.write(buffer[:min(chunk, size-n*chunk)])
+			attempts = 0
+		} else {
+			writer.discard(buffer)
+		}
+
+		// ok, continue
+		n++
+		if n < chunks {
+			err = c.Send(protocol.Command{Command: command})
+			if err != nil {
+				c.Abort()
+				return err
+			}
+		}
+	}
+
+	// finished
+	err = c.Send(protocol.Command{Command: comms.CMD_END})
+	if err != nil {
+		return err
+	}
+	err = s.imageCRC(c, crc, image)
+	if err != nil {
+		return err
+	}
+	return writer.close()
+}
+
+// seek makes the next transfer start at offset with CMD_ADDRESS. Offset
+// 0 is where transfers start anyway, and needs no FEATURE_ADDRESS.
+func (s *Session) seek(c *protocol.Conn, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	if !s.feature(FEATURE_ADDRESS) {
+		return ErrNoAddress
+	}
+	if offset < 0 || offset >= 1<<(8*protocol.ADDRESS_LEN) {
+		return fmt.Errorf("Address 0x%x out of range", offset)
+	}
+	msgs := []protocol.Message{protocol.Command{Command: comms.CMD_ADDRESS}}
+	for i := protocol.ADDRESS_LEN - 1; i >= 0; i-- {
+		msgs = append(msgs, protocol.Data{Data: uint8(offset >> (8 * i))})
+	}
+	err := c.Send(msgs...)
+	if err != nil {
+		return err
+	}
+	stat, err := c.ReceiveStat(s.timeout())
+	if err != nil {
+		c.Abort()
+		return err
+	}
+	if stat != STAT_OK {
+		return &StatusError{Op: "set the address", Status: stat}
+	}
+	return nil
+}
+
+// imageCRC keeps the CRC32 of the image of a finished transfer and, with
+// FEATURE_CRC32, compares crc, the one of all the chunks transferred, with
+// the one the device sends after CMD_END.
+func (s *Session) imageCRC(c *protocol.Conn, crc uint32, image uint32) error {
+	s.CRC32 = image
+	s.CRC32Checked = false
+	if !s.feature(FEATURE_CRC32) {
+		return nil
+	}
+	device, err := c.ReceiveCRC32(s.timeout())
+	if err != nil {
+		return err
+	}
+	if device != crc {
+		return &ImageCRCError{Expected: crc, Actual: device}
+	}
+	s.CRC32Checked = true
+	return nil
+}
+
+// check is the chunk check in use on the link.
+func (s *Session) check() comms.ChunkCheck {
+	if s.feature(FEATURE_CRC16) {
+		return comms.CHECK_CRC16
+	}
+	return comms.CHECK_SUM
+}
+
+// fail reports err on errchan, if there is one, and returns it. A nil
+// err is passed through.
+func fail(errchan chan error, err error) error {
+	if errchan != nil && err != nil {
+		errchan <- err
+	}
+	return err
+}
+
+type chunk struct {
+	data []uint8
+	err  error
+}
+
+// chunkReader reads a file ahead, chunk by chunk, in its own goroutine.
+// Buffers go back to it with release once sent.
+type chunkReader struct {
+	full chan chunk
+	free chan []uint8
+	stop chan struct{}
+}
+
+func newChunkReader(r io.Reader, chunks int64, size int64) *chunkReader {
+	cr := &chunkReader{
+		full: make(chan chunk, PIPELINE_DEPTH),
+		free: make(chan []uint8, PIPELINE_DEPTH),
+		stop: make(chan struct{}),
+	}
+	for range PIPELINE_DEPTH {
+		cr.free <- make([]uint8, size)
+	}
+
+	go func() {
+		defer close(cr.full)
+		for range chunks {
+			var buffer []uint8
+			select {
+			case buffer = <-cr.free:
+			case <-cr.stop:
+				return
+			}
+
+			// pad a short last chunk with erased flash
+			n, err := io.ReadFull(r, buffer)
+			if err == io.ErrUnexpectedEOF {
+				for i := n; i < len(buffer); i++ {
+					buffer[i] = 0xFF
+				}
+				err = nil
+			}
+
+			select {
+			case cr.full <- chunk{buffer, err}:
+			case <-cr.stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return cr
+}
+
+func (cr *chunkReader) next() ([]uint8, error) {
+	c, ok := <-cr.full
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return c.data, c.err
+}
+
+func (cr *chunkReader) release(buffer []uint8) {
+	cr.free <- buffer
+}
+
+func (cr *chunkReader) close() {
+	close(cr.stop)
+}
+
+// chunkWriter writes chunks to a file in its own goroutine. Buffers are
+// taken with buffer and handed back with write.
+type chunkWriter struct {
+	full   chan []uint8
+	free   chan []uint8
+	done   chan error
+	closed bool
+}
+
+func newChunkWriter(w io.Writer, size int64) *chunkWriter {
+	cw := &chunkWriter{
+		full: make(chan []uint8, PIPELINE_DEPTH),
+		free: make(chan []uint8, PIPELINE_DEPTH),
+		done: make(chan error, 1),
+	}
+	for range PIPELINE_DEPTH {
+		cw.free <- make([]uint8, size)
+	}
+
+	go func() {
+		var err error
+		for buffer := range cw.full {
+			if err == nil {
+				_, err = w.Write(buffer)
+			}
+			cw.free <- buffer[:cap(buffer)]
+		}
+		cw.done <- err
+	}()
+	return cw
+}
+
+func (cw *chunkWriter) buffer() []uint8 {
+	return <-cw.free
+}
+
+func (cw *chunkWriter) write(buffer []uint8) {
+	cw.full <- buffer
+}
+
+// discard hands back a buffer without writing it.
+func (cw *chunkWriter) discard(buffer []uint8) {
+	cw.free <- buffer
+}
+
+// close waits for the pending chunks and returns the first write error.
+func (cw *chunkWriter) close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	close(cw.full)
+	return <-cw.done
+}
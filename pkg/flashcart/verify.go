@@ -0,0 +1,181 @@
+package flashcart
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+)
+
+const (
+	ROM_BANK_SIZE = 0x4000
+	RAM_BANK_SIZE = 0x2000
+	// mismatches kept by a Comparison
+	MAX_MISMATCHES = 16
+)
+
+// Mismatch is a byte read back from the cart differing from the file.
+// Address is where it is in the cart and Bank the cart bank holding it.
+type Mismatch struct {
+	Address  int64
+	Bank     int64
+	Expected uint8
+	Actual   uint8
+}
+
+// BankDiff counts the differences in a cart bank.
+type BankDiff struct {
+	Bank      int64
+	Count     int64
+	Chunks    int64
+	BadChunks int64
+}
+
+// Comparison is the result of comparing the cart with a file, by bytes,
+// by BUFFER_SIZE chunks and by banks. Mismatches are the first
+// MAX_MISMATCHES of Count differing bytes. The file was compared with
+// the cart from Offset on.
+type Comparison struct {
+	Offset     int64
+	Size       int64
+	BankSize   int64
+	Count      int64
+	Chunks     int64
+	BadChunks  int64
+	Banks      []BankDiff
+	Mismatches []Mismatch
+}
+
+// Match tells whether the cart and the file are the same.
+func (c *Comparison) Match() bool {
+	return c.Count == 0
+}
+
+// VerifyError reports the cart contents differing from the file written.
+type VerifyError struct {
+	Comparison
+}
+
+func (e *VerifyError) Error() string {
+	m := e.Mismatches[0]
+	return fmt.Sprintf("Verify failed, %d bytes differ, first at 0x%06x (bank %d): expected 0x%02x, got 0x%02x",
+		e.Count, m.Address, m.Bank, m.Expected, m.Actual)
+}
+
+func (s *Session) CompareFlash(ctx context.Context, filename string, finished chan bool, progress chan int64, errchan chan error) (Comparison, error) {
+	// finishing
+	defer func() { finished <- true }()
+	cmp, err := s.compare(ctx, comms.CMD_READ_FLASH, filename, 0, progress)
+	return cmp, fail(errchan, err)
+}
+
+func (s *Session) CompareRAM(ctx context.Context, filename string, finished chan bool, progress chan int64, errchan chan error) (Comparison, error) {
+	// finishing
+	defer func() { finished <- true }()
+	cmp, err := s.compare(ctx, comms.CMD_READ_RAM, filename, 0, progress)
+	return cmp, fail(errchan, err)
+}
+
+// compare reads as many bytes as filename has from offset with command
+// and compares them with it as they arrive, without a dump on disk.
+func (s *Session) compare(ctx context.Context, command uint8, filename string, offset int64, progress chan int64) (Comparison, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Comparison{}, err
+	}
+	defer file.Close()
+	stats, err := file.Stat()
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	v := newVerifier(file, offset, stats.Size(), command)
+	err = s.readTo(ctx, command, "verify", v, offset, stats.Size(), progress)
+	if err != nil {
+		return Comparison{}, err
+	}
+	return v.cmp, nil
+}
+
+// verify reads back what write programmed with command from filename at
+// offset and compares it byte by byte.
+func (s *Session) verify(ctx context.Context, command uint8, filename string, offset int64, progress chan int64) error {
+	var read uint8 = comms.CMD_READ_FLASH
+	if command == comms.CMD_PRG_RAM {
+		read = comms.CMD_READ_RAM
+	}
+
+	// keep the count and CRC32 of the write
+	retries, crc, checked := s.Retries, s.CRC32, s.CRC32Checked
+	cmp, err := s.compare(ctx, read, filename, offset, progress)
+	s.Retries += retries
+	s.CRC32, s.CRC32Checked = crc, checked
+	if err != nil {
+		return err
+	}
+	if !cmp.Match() {
+		return &VerifyError{cmp}
+	}
+	return nil
+}
+
+// verifier is an io.Writer comparing what is written to it with src.
+type verifier struct {
+	src      io.Reader
+	addr     int64
+	expected []uint8
+	// last chunk counted as bad
+	bad int64
+	cmp Comparison
+}
+
+func newVerifier(src io.Reader, offset int64, size int64, command uint8) *verifier {
+	var bank int64 = ROM_BANK_SIZE
+	if command == comms.CMD_READ_RAM {
+		bank = RAM_BANK_SIZE
+	}
+	v := &verifier{src: src, addr: offset, bad: -1}
+	v.cmp = Comparison{Offset: offset, Size: size, BankSize: bank, Chunks: (size + BUFFER_SIZE - 1) / BUFFER_SIZE}
+	// the banks the file covers, in part or whole
+	for b := offset / bank; b*bank < offset+size; b++ {
+		start, end := max(b*bank, offset), min((b+1)*bank, offset+size)
+		chunks := (end - start + BUFFER_SIZE - 1) / BUFFER_SIZE
+		v.cmp.Banks = append(v.cmp.Banks, BankDiff{Bank: b, Chunks: chunks})
+	}
+	return v
+}
+
+func (v *verifier) Write(data []uint8) (int, error) {
+	if cap(v.expected) < len(data) {
+		v.expected = make([]uint8, len(data))
+	}
+	expected := v.expected[:len(data)]
+	_, err := io.ReadFull(v.src, expected)
+	if err != nil {
+		return 0, err
+	}
+	for i := range data {
+		if data[i] != expected[i] {
+			v.mismatch(v.addr+int64(i), expected[i], data[i])
+		}
+	}
+	v.addr += int64(len(data))
+	return len(data), nil
+}
+
+func (v *verifier) mismatch(addr int64, expected uint8, actual uint8) {
+	bank := &v.cmp.Banks[addr/v.cmp.BankSize-v.cmp.Offset/v.cmp.BankSize]
+	v.cmp.Count++
+	bank.Count++
+	// addresses only go up, a chunk is counted once
+	if chunk := (addr - v.cmp.Offset) / BUFFER_SIZE; chunk != v.bad {
+		v.bad = chunk
+		v.cmp.BadChunks++
+		bank.BadChunks++
+	}
+	if len(v.cmp.Mismatches) < MAX_MISMATCHES {
+		v.cmp.Mismatches = append(v.cmp.Mismatches, Mismatch{addr, bank.Bank, expected, actual})
+	}
+}
@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+)
+
+// Conn exchanges messages with a device, checking their order with its
+// Machine.
+type Conn struct {
+	Transport comms.Transport
+	Machine
+	// reused for the coalesced writes
+	out []uint8
+}
+
+func NewConn(gbs comms.Transport) *Conn {
+	return &Conn{Transport: gbs}
+}
+
+// Send checks all msgs are in sequence and sends them in a single write.
+// Nothing is sent if one is not.
+func (c *Conn) Send(msgs ...Message) error {
+	m := c.Machine
+	for _, msg := range msgs {
+		if err := m.Send(msg); err != nil {
+			return err
+		}
+	}
+	c.Machine = m
+	c.out = Encode(c.out[:0], msgs...)
+	return c.Transport.SendBuffer(c.out)
+}
+
+// Receive reads the next packet from the device and checks it was
+// expected. A failed receive leaves the state as it was.
+func (c *Conn) Receive(timeout time.Duration) (Message, error) {
+	packet, err := c.Transport.ReceivePacket(timeout)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := DecodePacket(packet)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Machine.Receive(msg); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+// ReceiveChunk reads a chunk of raw bytes into buffer.
+func (c *Conn) ReceiveChunk(buffer []uint8, timeout time.Duration) error {
+	if c.state != AwaitChunk {
+		return &SequenceError{State: c.state, Command: c.command, Message: Chunk{buffer}}
+	}
+	err := c.Transport.ReceiveBuffer(buffer, timeout)
+	if err != nil {
+		return err
+	}
+	return c.Machine.Receive(Chunk{buffer})
+}
+
+// ReceiveInfo reads a TYPE_INFO packet and returns its value.
+func (c *Conn) ReceiveInfo(timeout time.Duration) (uint8, error) {
+	state := c.state
+	msg, err := c.Receive(timeout)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := msg.(Info)
+	if !ok {
+		return 0, &SequenceError{State: state, Command: c.command, Message: msg}
+	}
+	return m.Data, nil
+}
+
+// ReceiveData reads a TYPE_DATA packet and returns its value.
+func (c *Conn) ReceiveData(timeout time.Duration) (uint8, error) {
+	state := c.state
+	msg, err := c.Receive(timeout)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := msg.(Data)
+	if !ok {
+		return 0, &SequenceError{State: state, Command: c.command, Message: msg}
+	}
+	return m.Data, nil
+}
+
+// ReceiveStat reads a TYPE_STAT packet and returns the status.
+func (c *Conn) ReceiveStat(timeout time.Duration) (uint8, error) {
+	state := c.state
+	msg, err := c.Receive(timeout)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := msg.(Stat)
+	if !ok {
+		return 0, &SequenceError{State: state, Command: c.command, Message: msg}
+	}
+	return m.Status, nil
+}
+
+// Abort ends whatever the device was doing, drops what it had sent and
+// goes back to Idle.
+func (c *Conn) Abort() {
+	c.Transport.SendPacket(comms.Packet{Type: comms.TYPE_COMMAND, Data: comms.CMD_END})
+	c.Transport.Purge()
+	c.Reset()
+}
+
+// ReceiveCheck reads the check of a chunk sent by the device, one or two
+// TYPE_DATA packets depending on kind.
+func (c *Conn) ReceiveCheck(kind comms.ChunkCheck, timeout time.Duration) (uint16, error) {
+	var check uint16 = 0
+	for range len(CheckData(kind, 0)) {
+		data, err := c.ReceiveData(timeout)
+		if err != nil {
+			return 0, err
+		}
+		check = check<<8 | uint16(data)
+	}
+	return check, nil
+}
+
+// ReceiveCRC32 reads the image CRC32 the device sends after CMD_END with
+// FEATURE_CRC32, four TYPE_DATA packets with the high byte first.
+func (c *Conn) ReceiveCRC32(timeout time.Duration) (uint32, error) {
+	var crc uint32 = 0
+	for range 4 {
+		data, err := c.ReceiveData(timeout)
+		if err != nil {
+			return 0, err
+		}
+		crc = crc<<8 | uint32(data)
+	}
+	return crc, nil
+}
@@ -0,0 +1,279 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+)
+
+// State is where a command exchange is, from the host side.
+type State int
+
+const (
+	Idle        State = iota // no command running
+	AwaitInfo                // handshake sent, TYPE_INFO answers to come
+	AwaitData                // TYPE_DATA answers to come
+	AwaitStat                // a TYPE_STAT answer to come
+	SendChunk                // the host sends a chunk to program
+	AwaitEcho                // the check of the programmed chunk to come
+	SendVerdict              // the host accepts or rejects the echo, FEATURE_RETRY
+	Next                     // the host repeats the command or sends CMD_END
+	AwaitChunk               // a chunk read from the cart to come
+	SendCheck                // the host sends the check of the chunk read
+	SendConfig               // the host sends the link settings
+	AwaitCRC                 // the image CRC32 to come, FEATURE_CRC32
+	SendAddress              // the host sends a start address, FEATURE_ADDRESS
+)
+
+var stateNames = []string{
+	"idle", "awaiting info", "awaiting data", "awaiting status",
+	"sending chunk", "awaiting echo", "sending verdict", "awaiting next command",
+	"awaiting chunk", "sending check", "sending config", "awaiting CRC32",
+	"sending address",
+}
+
+func (st State) String() string {
+	if st >= 0 && int(st) < len(stateNames) {
+		return stateNames[st]
+	}
+	return fmt.Sprintf("state %d", int(st))
+}
+
+// Machine follows the command exchanges with a device and rejects the
+// messages which don't belong where the exchange is. Features are the
+// protocol features enabled on the link.
+type Machine struct {
+	Features uint8
+
+	state   State
+	command uint8
+	// messages left in the current state
+	count int
+}
+
+// SequenceError reports a message out of sequence, sent by the host when
+// Sent is set or received from the device.
+type SequenceError struct {
+	State   State
+	Command uint8
+	Message Message
+	Sent    bool
+}
+
+func (e *SequenceError) Error() string {
+	dir := "received"
+	if e.Sent {
+		dir = "sent"
+	}
+	return fmt.Sprintf("Unexpected %v %s while %v (command 0x%02x)", e.Message, dir, e.State, e.Command)
+}
+
+func (m *Machine) State() State {
+	return m.state
+}
+
+// Command is the command running, or the last one.
+func (m *Machine) Command() uint8 {
+	return m.command
+}
+
+// Reset goes back to Idle, after the device has been resynchronized.
+func (m *Machine) Reset() {
+	m.state = Idle
+	m.count = 0
+}
+
+func (m *Machine) set(state State, count int) {
+	m.state = state
+	m.count = count
+}
+
+func (m *Machine) feature(f uint8) bool {
+	return m.Features&f != 0
+}
+
+// checkLen is how many TYPE_DATA packets carry a chunk check.
+func (m *Machine) checkLen() int {
+	if m.feature(FEATURE_CRC16) {
+		return 2
+	}
+	return 1
+}
+
+// Send checks the host may send msg now and moves on. CMD_END can always
+// be sent, it ends whatever was running.
+func (m *Machine) Send(msg Message) error {
+	bad := &SequenceError{State: m.state, Command: m.command, Message: msg, Sent: true}
+	switch msg := msg.(type) {
+	case Command:
+		if msg.Command == comms.CMD_END {
+			m.end()
+			return nil
+		}
+		if m.state == Idle {
+			return m.start(msg.Command, bad)
+		}
+		if m.state == Next && msg.Command == m.command {
+			m.next()
+			return nil
+		}
+	case Info:
+		if m.state == Idle {
+			m.set(AwaitInfo, 3)
+			return nil
+		}
+	case Data:
+		if m.state == SendCheck || m.state == SendConfig || m.state == SendAddress {
+			m.count--
+			if m.count == 0 {
+				m.set(AwaitStat, 1)
+			}
+			return nil
+		}
+	case Stat:
+		if m.state == SendVerdict && msg.Status == STAT_OK {
+			m.set(Next, 0)
+			return nil
+		}
+		if m.state == SendVerdict && msg.Status == STAT_RETRY {
+			m.set(SendChunk, 0)
+			return nil
+		}
+	case Chunk:
+		if m.state == SendChunk {
+			m.set(AwaitEcho, m.checkLen())
+			return nil
+		}
+	}
+	return bad
+}
+
+func (m *Machine) start(command uint8, bad error) error {
+	switch command {
+	case comms.CMD_ID:
+		m.set(AwaitData, 2)
+	case comms.CMD_READ_HEADER:
+		// cart type, ROM size, RAM size and the 16 byte title
+		m.set(AwaitData, 19)
+	case comms.CMD_ERASE_FLASH, comms.CMD_PRG_FLASH, comms.CMD_PRG_RAM:
+		m.set(AwaitStat, 1)
+	case comms.CMD_ERASE_RAM:
+		// acknowledge and first chunk erased
+		m.set(AwaitStat, 2)
+	case comms.CMD_READ_FLASH, comms.CMD_READ_RAM:
+		m.set(AwaitChunk, 0)
+	case comms.CMD_CONFIG:
+		// baud rates, largest chunk and features
+		m.set(AwaitData, 3)
+	case comms.CMD_ADDRESS:
+		if !m.feature(FEATURE_ADDRESS) {
+			return bad
+		}
+		m.set(SendAddress, ADDRESS_LEN)
+	default:
+		return bad
+	}
+	m.command = command
+	return nil
+}
+
+func (m *Machine) next() {
+	switch m.command {
+	case comms.CMD_PRG_FLASH, comms.CMD_PRG_RAM:
+		m.set(SendChunk, 0)
+	case comms.CMD_READ_FLASH, comms.CMD_READ_RAM:
+		m.set(AwaitChunk, 0)
+	case comms.CMD_ERASE_RAM:
+		m.set(AwaitStat, 1)
+	}
+}
+
+func (m *Machine) end() {
+	transfer := m.command == comms.CMD_PRG_FLASH || m.command == comms.CMD_PRG_RAM ||
+		m.command == comms.CMD_READ_FLASH || m.command == comms.CMD_READ_RAM
+	if m.state == Next && transfer && m.feature(FEATURE_CRC32) {
+		m.set(AwaitCRC, 4)
+		return
+	}
+	m.set(Idle, 0)
+}
+
+// Receive checks msg was expected from the device now and moves on.
+func (m *Machine) Receive(msg Message) error {
+	bad := &SequenceError{State: m.state, Command: m.command, Message: msg}
+	switch msg := msg.(type) {
+	case Info:
+		if m.state == AwaitInfo {
+			m.count--
+			if m.count == 0 {
+				m.set(Idle, 0)
+			}
+			return nil
+		}
+	case Data:
+		switch m.state {
+		case AwaitData:
+			m.count--
+			if m.count == 0 && m.command == comms.CMD_CONFIG {
+				m.set(SendConfig, 3)
+			} else if m.count == 0 {
+				m.set(Idle, 0)
+			}
+			return nil
+		case AwaitEcho:
+			m.count--
+			if m.count == 0 && m.feature(FEATURE_RETRY) {
+				m.set(SendVerdict, 0)
+			} else if m.count == 0 {
+				m.set(Next, 0)
+			}
+			return nil
+		case AwaitCRC:
+			m.count--
+			if m.count == 0 {
+				m.set(Idle, 0)
+			}
+			return nil
+		}
+	case Stat:
+		if m.state == AwaitStat {
+			m.status(msg.Status)
+			return nil
+		}
+	case Chunk:
+		if m.state == AwaitChunk {
+			m.set(SendCheck, m.checkLen())
+			return nil
+		}
+	}
+	return bad
+}
+
+// status moves on after a status answer, which ends the command unless
+// it is STAT_OK.
+func (m *Machine) status(status uint8) {
+	ok := status == STAT_OK
+	switch m.command {
+	case comms.CMD_PRG_FLASH, comms.CMD_PRG_RAM:
+		if ok {
+			m.set(SendChunk, 0)
+			return
+		}
+	case comms.CMD_READ_FLASH, comms.CMD_READ_RAM:
+		// a rejected check is read again with FEATURE_RETRY
+		if ok || status == STAT_RETRY && m.feature(FEATURE_RETRY) {
+			m.set(Next, 0)
+			return
+		}
+	case comms.CMD_ERASE_RAM:
+		m.count--
+		if ok && m.count > 0 {
+			return
+		}
+		if ok {
+			m.set(Next, 0)
+			return
+		}
+	}
+	m.set(Idle, 0)
+}
@@ -0,0 +1,107 @@
+// Package protocol describes the packets exchanged with the GBShooper
+// firmware as typed messages, and checks their order with a state machine
+// following each command exchange.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+)
+
+const (
+	GBS_ID = 0x17 // 23 decimal
+
+	// status
+	STAT_OK      = 0x14 // 10.4 ;-)
+	STAT_ERROR   = 0xEE
+	STAT_TIMEOUT = 0xAA
+	STAT_RETRY   = 0x52 // chunk to be sent again, with FEATURE_RETRY
+
+	// protocol features in the CMD_CONFIG bitmask
+	FEATURE_RETRY   = 0x01 // bad chunks are sent again instead of ending the transfer
+	FEATURE_CRC16   = 0x02 // chunks are checked with CRC16 instead of the 8-bit sum
+	FEATURE_CRC32   = 0x04 // the device sends the CRC32 of the image after CMD_END
+	FEATURE_ADDRESS = 0x08 // CMD_ADDRESS sets where the next transfer starts
+
+	// TYPE_DATA packets of a CMD_ADDRESS, high byte first
+	ADDRESS_LEN = 3
+)
+
+// Message is a unit of the protocol. All but Chunk are two byte packets.
+type Message interface {
+	Encode() []uint8
+}
+
+// Info is the handshake, sent empty by the host and answered with the
+// GBS_ID and the two version digits.
+type Info struct {
+	Data uint8
+}
+
+// Command starts or continues a command, or ends it with CMD_END.
+type Command struct {
+	Command uint8
+}
+
+// Data is an answer value, a checksum or a link setting.
+type Data struct {
+	Data uint8
+}
+
+// Stat is a status, from the device, or a verdict from the host.
+type Stat struct {
+	Status uint8
+}
+
+// Chunk is a block of raw bytes being programmed or read, not framed.
+type Chunk struct {
+	Data []uint8
+}
+
+func (m Info) Encode() []uint8    { return []uint8{comms.TYPE_INFO, m.Data} }
+func (m Command) Encode() []uint8 { return []uint8{comms.TYPE_COMMAND, m.Command} }
+func (m Data) Encode() []uint8    { return []uint8{comms.TYPE_DATA, m.Data} }
+func (m Stat) Encode() []uint8    { return []uint8{comms.TYPE_STAT, m.Status} }
+func (m Chunk) Encode() []uint8   { return m.Data }
+
+func (m Info) String() string    { return fmt.Sprintf("TYPE_INFO 0x%02x", m.Data) }
+func (m Command) String() string { return fmt.Sprintf("TYPE_COMMAND 0x%02x", m.Command) }
+func (m Data) String() string    { return fmt.Sprintf("TYPE_DATA 0x%02x", m.Data) }
+func (m Stat) String() string    { return fmt.Sprintf("TYPE_STAT 0x%02x", m.Status) }
+func (m Chunk) String() string   { return fmt.Sprintf("%d byte chunk", len(m.Data)) }
+
+// ErrBadType is returned for a packet of none of the known types.
+var ErrBadType = errors.New("Unknown packet type")
+
+// Encode appends msgs to data, joined to be sent in a single write.
+func Encode(data []uint8, msgs ...Message) []uint8 {
+	for _, m := range msgs {
+		data = append(data, m.Encode()...)
+	}
+	return data
+}
+
+func DecodePacket(packet comms.Packet) (Message, error) {
+	switch packet.Type {
+	case comms.TYPE_INFO:
+		return Info{packet.Data}, nil
+	case comms.TYPE_COMMAND:
+		return Command{packet.Data}, nil
+	case comms.TYPE_DATA:
+		return Data{packet.Data}, nil
+	case comms.TYPE_STAT:
+		return Stat{packet.Data}, nil
+	}
+	return nil, fmt.Errorf("%w 0x%02x", ErrBadType, packet.Type)
+}
+
+// CheckData returns the TYPE_DATA messages carrying a chunk check, with
+// the high byte first for CHECK_CRC16.
+func CheckData(kind comms.ChunkCheck, check uint16) []Message {
+	if kind == comms.CHECK_CRC16 {
+		return []Message{Data{uint8(check >> 8)}, Data{uint8(check)}}
+	}
+	return []Message{Data{uint8(check)}}
+}
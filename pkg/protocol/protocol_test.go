@@ -0,0 +1,238 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+)
+
+// commands a fuzzed exchange can start with
+var commands = []uint8{
+	comms.CMD_ID, comms.CMD_READ_FLASH, comms.CMD_READ_RAM, comms.CMD_PRG_FLASH,
+	comms.CMD_PRG_RAM, comms.CMD_ERASE_FLASH, comms.CMD_ERASE_RAM,
+	comms.CMD_READ_HEADER, comms.CMD_CONFIG,
+}
+
+// wire is a device answering with fixed bytes, and then nothing.
+type wire struct {
+	in  []uint8
+	out []uint8
+}
+
+func (w *wire) SendByte(data uint8) error {
+	w.out = append(w.out, data)
+	return nil
+}
+
+func (w *wire) SendPacket(packet comms.Packet) error {
+	w.out = append(w.out, packet.Type, packet.Data)
+	return nil
+}
+
+func (w *wire) SendBuffer(buffer []uint8) error {
+	w.out = append(w.out, buffer...)
+	return nil
+}
+
+func (w *wire) ReceiveByte(timeout time.Duration) (uint8, error) {
+	buffer := make([]uint8, 1)
+	err := w.ReceiveBuffer(buffer, timeout)
+	return buffer[0], err
+}
+
+func (w *wire) ReceivePacket(timeout time.Duration) (comms.Packet, error) {
+	buffer := make([]uint8, 2)
+	err := w.ReceiveBuffer(buffer, timeout)
+	return comms.Packet{Type: buffer[0], Data: buffer[1]}, err
+}
+
+func (w *wire) ReceiveBuffer(buffer []uint8, timeout time.Duration) error {
+	if len(w.in) < len(buffer) {
+		return comms.ErrTimeout
+	}
+	copy(buffer, w.in)
+	w.in = w.in[len(buffer):]
+	return nil
+}
+
+func (w *wire) Purge() error { return nil }
+func (w *wire) Close() error { return nil }
+
+func FuzzDecodePacket(f *testing.F) {
+	f.Add(uint8(comms.TYPE_INFO), uint8(GBS_ID))
+	f.Add(uint8(comms.TYPE_STAT), uint8(STAT_OK))
+	f.Add(uint8(0x00), uint8(0xFF))
+	f.Fuzz(func(t *testing.T, kind uint8, data uint8) {
+		msg, err := DecodePacket(comms.Packet{Type: kind, Data: data})
+		if err != nil {
+			if msg != nil || !errors.Is(err, ErrBadType) {
+				t.Fatalf("message %v with error %v", msg, err)
+			}
+			return
+		}
+		if got := msg.Encode(); got[0] != kind || got[1] != data {
+			t.Fatalf("%02x %02x decoded as %v, encoded back as % x", kind, data, msg, got)
+		}
+	})
+}
+
+// FuzzReceive feeds garbage, as sent by a device behind a dirty
+// connector, to a Conn following an exchange.
+func FuzzReceive(f *testing.F) {
+	f.Add(uint8(0), uint8(0), []uint8{comms.TYPE_DATA, 0x01, comms.TYPE_DATA, 0xA4})
+	f.Add(uint8(1), uint8(FEATURE_RETRY|FEATURE_CRC16), []uint8{comms.TYPE_STAT, STAT_RETRY, comms.TYPE_DATA})
+	f.Add(uint8(3), uint8(FEATURE_CRC32), []uint8{comms.TYPE_STAT, STAT_OK, comms.TYPE_DATA, 0x12, comms.TYPE_STAT, STAT_OK})
+	f.Add(uint8(6), uint8(0), []uint8{comms.TYPE_STAT, STAT_OK, comms.TYPE_STAT, STAT_ERROR})
+	f.Add(uint8(8), uint8(0), []uint8{comms.TYPE_STAT, STAT_ERROR, 0x55, 0xAA})
+	f.Fuzz(func(t *testing.T, command uint8, features uint8, data []uint8) {
+		c := NewConn(&wire{in: data})
+		c.Features = features
+		if err := c.Send(Command{commands[int(command)%len(commands)]}); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			before := c.Machine
+			var err error
+			if c.State() == AwaitChunk {
+				err = c.ReceiveChunk(make([]uint8, 4), time.Millisecond)
+			} else {
+				_, err = c.Receive(time.Millisecond)
+			}
+			if errors.Is(err, comms.ErrTimeout) {
+				break
+			}
+			var seq *SequenceError
+			if err != nil && !errors.Is(err, ErrBadType) && !errors.As(err, &seq) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err != nil && c.Machine != before {
+				t.Fatalf("%v changed the state from %v to %v", err, before.State(), c.State())
+			}
+			if err != nil {
+				continue
+			}
+			// the host answers what it is asked for, or gives up
+			switch c.State() {
+			case SendChunk:
+				err = c.Send(Chunk{make([]uint8, 4)})
+			case SendVerdict:
+				err = c.Send(Stat{STAT_OK})
+			case SendCheck, SendConfig:
+				for c.State() == SendCheck || c.State() == SendConfig {
+					if err = c.Send(Data{0x00}); err != nil {
+						break
+					}
+				}
+			case Next:
+				err = c.Send(Command{c.Command()})
+			}
+			if err != nil {
+				t.Fatalf("can't answer in %v: %v", c.State(), err)
+			}
+		}
+		if err := c.Send(Command{comms.CMD_END}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// step is a message sent by the host, or received from the device.
+type step struct {
+	msg  Message
+	sent bool
+}
+
+func sent(msg Message) step     { return step{msg, true} }
+func received(msg Message) step { return step{msg, false} }
+
+// TestMachineSequence checks messages out of sequence are rejected and
+// leave the state as it was.
+func TestMachineSequence(t *testing.T) {
+	tests := []struct {
+		name     string
+		features uint8
+		steps    []step
+		bad      step
+		state    State
+	}{
+		{"status awaiting data", 0,
+			[]step{sent(Command{comms.CMD_ID})},
+			received(Stat{STAT_OK}), AwaitData},
+		{"data after CMD_END", 0,
+			[]step{sent(Command{comms.CMD_PRG_FLASH}), received(Stat{STAT_OK}), sent(Chunk{make([]uint8, 4)}),
+				received(Data{0x00}), sent(Command{comms.CMD_END})},
+			received(Data{0x00}), Idle},
+		{"data after the CRC32", FEATURE_CRC32,
+			[]step{sent(Command{comms.CMD_READ_RAM}), received(Chunk{make([]uint8, 4)}), sent(Data{0x00}),
+				received(Stat{STAT_OK}), sent(Command{comms.CMD_END}),
+				received(Data{0x00}), received(Data{0x00}), received(Data{0x00}), received(Data{0x00})},
+			received(Data{0x00}), Idle},
+		{"second info", 0,
+			[]step{sent(Info{}), received(Info{GBS_ID}), received(Info{0x01}), received(Info{0x01})},
+			received(Info{GBS_ID}), Idle},
+		{"info during a command", 0,
+			[]step{sent(Command{comms.CMD_READ_HEADER})},
+			received(Info{GBS_ID}), AwaitData},
+		{"chunk awaiting the echo", 0,
+			[]step{sent(Command{comms.CMD_PRG_RAM}), received(Stat{STAT_OK}), sent(Chunk{make([]uint8, 4)})},
+			received(Chunk{make([]uint8, 4)}), AwaitEcho},
+		{"chunk before the status", 0,
+			[]step{sent(Command{comms.CMD_PRG_FLASH})},
+			sent(Chunk{make([]uint8, 4)}), AwaitStat},
+		{"verdict without retries", 0,
+			[]step{sent(Command{comms.CMD_PRG_FLASH}), received(Stat{STAT_OK}), sent(Chunk{make([]uint8, 4)}),
+				received(Data{0x00})},
+			sent(Stat{STAT_RETRY}), Next},
+		{"another command", 0,
+			[]step{sent(Command{comms.CMD_READ_FLASH}), received(Chunk{make([]uint8, 4)}), sent(Data{0x00}),
+				received(Stat{STAT_OK})},
+			sent(Command{comms.CMD_READ_RAM}), Next},
+		{"address without the feature", 0,
+			nil,
+			sent(Command{comms.CMD_ADDRESS}), Idle},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Machine{Features: tt.features}
+			for _, s := range tt.steps {
+				var err error
+				if s.sent {
+					err = m.Send(s.msg)
+				} else {
+					err = m.Receive(s.msg)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var err error
+			if tt.bad.sent {
+				err = m.Send(tt.bad.msg)
+			} else {
+				err = m.Receive(tt.bad.msg)
+			}
+			var seq *SequenceError
+			if !errors.As(err, &seq) {
+				t.Fatalf("%v not rejected: %v", tt.bad.msg, err)
+			}
+			if seq.State != tt.state || seq.Sent != tt.bad.sent || !reflect.DeepEqual(seq.Message, tt.bad.msg) {
+				t.Fatalf("got %v", seq)
+			}
+			if m.State() != tt.state {
+				t.Fatalf("state moved to %v", m.State())
+			}
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	got := Encode([]uint8{0x01}, Command{comms.CMD_PRG_RAM}, Chunk{[]uint8{0x5A, 0xA5}}, Data{0x12})
+	want := []uint8{0x01, comms.TYPE_COMMAND, comms.CMD_PRG_RAM, 0x5A, 0xA5, comms.TYPE_DATA, 0x12}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got % x, want % x", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+// TestCancel cancels transfers half way, and checks the device got
+// CMD_END and the session can go on.
+func TestCancel(t *testing.T) {
+	tests := []struct {
+		name   string
+		device func() *Device
+		op     func(ctx context.Context, s *flashcart.Session, rom string, dump string, f chan bool, p chan int64, e chan error) error
+	}{
+		{"write", New, func(ctx context.Context, s *flashcart.Session, rom string, dump string, f chan bool, p chan int64, e chan error) error {
+			return s.WriteFlash(ctx, rom, f, p, e)
+		}},
+		{"read", New, func(ctx context.Context, s *flashcart.Session, rom string, dump string, f chan bool, p chan int64, e chan error) error {
+			return s.ReadFlash(ctx, dump, flashcart.S_32K, f, p, e)
+		}},
+		{"write with CRC32", newer, func(ctx context.Context, s *flashcart.Session, rom string, dump string, f chan bool, p chan int64, e chan error) error {
+			return s.WriteFlash(ctx, rom, f, p, e)
+		}},
+		{"read with CRC32", newer, func(ctx context.Context, s *flashcart.Session, rom string, dump string, f chan bool, p chan int64, e chan error) error {
+			return s.ReadFlash(ctx, dump, flashcart.S_32K, f, p, e)
+		}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			rom, _ := image(t, dir, "rom.gb", flashcart.S_32K, int64(i))
+			dump := filepath.Join(dir, "dump.gb")
+			d := tt.device()
+			var trace bytes.Buffer
+			s, err := flashcart.NewSession(context.Background(), comms.NewTracer(d, &trace))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			// cancelled half way
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			progress := make(chan int64)
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case percent := <-progress:
+						if percent >= 50 {
+							cancel()
+						}
+					case <-done:
+						return
+					}
+				}
+			}()
+			err = tt.op(ctx, s, rom, dump, make(chan bool, 1), progress, make(chan error, 1))
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got error %v", err)
+			}
+			sent := strings.Split(strings.TrimSpace(trace.String()), "\n")
+			last := ""
+			for _, line := range sent {
+				if strings.Contains(line, " > ") {
+					last = line
+				}
+			}
+			if !strings.HasSuffix(last, "> 11 ff") {
+				t.Fatalf("last sent %q, not CMD_END", last)
+			}
+			d.mu.Lock()
+			state := d.fw.state
+			d.mu.Unlock()
+			if state != stIdle {
+				t.Fatalf("device left in state %d", state)
+			}
+
+			// the session still works
+			if _, err := s.Status(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			err = run(func(f chan bool, p chan int64, e chan error) error {
+				return tt.op(context.Background(), s, rom, dump, f, p, e)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
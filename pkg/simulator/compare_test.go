@@ -0,0 +1,121 @@
+package simulator
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		ram  bool
+		size int
+		// cart bytes changed after loading the file
+		changed []int
+		chunks  int64
+		bad     int64
+		banks   []flashcart.BankDiff
+	}{
+		{"flash matching", false, flashcart.S_32K, nil, 128, 0,
+			[]flashcart.BankDiff{{Bank: 0, Chunks: 64}, {Bank: 1, Chunks: 64}}},
+		{"flash differing", false, flashcart.S_32K, []int{0x10, 0x11, 0x4300}, 128, 2,
+			[]flashcart.BankDiff{{Bank: 0, Count: 2, Chunks: 64, BadChunks: 1}, {Bank: 1, Count: 1, Chunks: 64, BadChunks: 1}}},
+		{"RAM odd size", true, 10000, []int{0x2005, 0x20FF, 0x2100}, 40, 2,
+			[]flashcart.BankDiff{{Bank: 0, Chunks: 32}, {Bank: 1, Count: 3, Chunks: 8, BadChunks: 2}}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename, data := image(t, t.TempDir(), "image.bin", tt.size, int64(i))
+			d := New()
+			mem := d.Flash
+			if tt.ram {
+				mem = d.RAM
+			}
+			copy(mem, data)
+			for _, addr := range tt.changed {
+				mem[addr] ^= 0xFF
+			}
+
+			var cmp flashcart.Comparison
+			err := run(func(f chan bool, p chan int64, e chan error) error {
+				var err error
+				if tt.ram {
+					cmp, err = session(d).CompareRAM(ctx, filename, f, p, e)
+				} else {
+					cmp, err = session(d).CompareFlash(ctx, filename, f, p, e)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmp.Match() != (len(tt.changed) == 0) || cmp.Count != int64(len(tt.changed)) {
+				t.Fatalf("%d bytes differ", cmp.Count)
+			}
+			if cmp.Size != int64(tt.size) || cmp.Chunks != tt.chunks || cmp.BadChunks != tt.bad {
+				t.Fatalf("%d bytes, %d of %d chunks bad", cmp.Size, cmp.BadChunks, cmp.Chunks)
+			}
+			if !slices.Equal(cmp.Banks, tt.banks) {
+				t.Fatalf("banks %+v", cmp.Banks)
+			}
+			for j, m := range cmp.Mismatches {
+				addr := tt.changed[j]
+				if m.Address != int64(addr) || m.Expected != data[addr] || m.Actual != data[addr]^0xFF {
+					t.Fatalf("mismatch %+v", m)
+				}
+			}
+		})
+	}
+}
+
+// TestCompareError checks a comparison failing mid stream reports the
+// error and finishes, waited on like the CLI does.
+func TestCompareError(t *testing.T) {
+	ctx := context.Background()
+	filename, data := image(t, t.TempDir(), "rom.gb", flashcart.S_32K, 1)
+	d := New()
+	copy(d.Flash, data)
+	d.SetFaults(Faults{SilentAfter: 10000})
+
+	progress := make(chan int64)
+	finished := make(chan bool)
+	errchan := make(chan error)
+	returned := make(chan error, 1)
+	go func() {
+		_, err := session(d).CompareFlash(ctx, filename, finished, progress, errchan)
+		returned <- err
+	}()
+
+	var err error
+	timeout := time.After(5 * time.Second)
+outer:
+	for {
+		select {
+		case <-finished:
+			break outer
+		case <-progress:
+		case err = <-errchan:
+			select {
+			case <-finished:
+			case <-timeout:
+				t.Fatal("not finished after the error")
+			}
+			break outer
+		case <-timeout:
+			t.Fatal("comparison hung")
+		}
+	}
+	if !errors.Is(err, comms.ErrTimeout) {
+		t.Fatalf("got error %v", err)
+	}
+	if err := <-returned; !errors.Is(err, comms.ErrTimeout) {
+		t.Fatalf("returned error %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+// badCRC flips the CRC32 the device sends after CMD_END.
+type badCRC struct {
+	*Device
+	end bool
+}
+
+func (b *badCRC) SendBuffer(buffer []uint8) error {
+	b.end = bytes.HasSuffix(buffer, []uint8{comms.TYPE_COMMAND, comms.CMD_END})
+	return b.Device.SendBuffer(buffer)
+}
+
+func (b *badCRC) ReceivePacket(timeout time.Duration) (comms.Packet, error) {
+	packet, err := b.Device.ReceivePacket(timeout)
+	if b.end && packet.Type == comms.TYPE_DATA {
+		packet.Data ^= 0x01
+	}
+	return packet, err
+}
+
+func TestImageCRC(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		ram  bool
+		size int
+		// the device flips the CRC32
+		bad bool
+	}{
+		{"flash write, part of a chunk", false, 1000, false},
+		{"RAM read, MBC2", true, flashcart.S_512, false},
+		{"flash write, whole chunks", false, flashcart.S_32K, false},
+		{"flash write, bad CRC32", false, flashcart.S_32K, true},
+		{"RAM read, bad CRC32", true, flashcart.S_8K, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename, data := image(t, dir, "image.bin", tt.size, int64(i))
+			dump := filepath.Join(dir, "dump.bin")
+			d := newer()
+			if tt.ram {
+				d.RAM = bytes.Clone(data)
+			}
+			var gbs comms.Transport = d
+			if tt.bad {
+				gbs = &badCRC{Device: d}
+			}
+			s, err := flashcart.NewSession(ctx, gbs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = run(func(f chan bool, p chan int64, e chan error) error {
+				if tt.ram {
+					return s.ReadRAM(ctx, dump, int64(tt.size), f, p, e)
+				}
+				return s.WriteFlash(ctx, filename, f, p, e)
+			})
+			var crcErr *flashcart.ImageCRCError
+			if tt.bad {
+				if !errors.As(err, &crcErr) || crcErr.Expected != crcErr.Actual^0x01010101 {
+					t.Fatalf("got error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !s.CRC32Checked || s.CRC32 != crc32.ChecksumIEEE(data) {
+				t.Fatalf("CRC32 %08x (checked %v), the file's is %08x", s.CRC32, s.CRC32Checked, crc32.ChecksumIEEE(data))
+			}
+			if tt.ram {
+				read, err := os.ReadFile(dump)
+				if err != nil || !bytes.Equal(read, data) {
+					t.Fatalf("dump differs from RAM: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestChunkCRC16 checks chunks go with their CRC16 once negotiated, and
+// that one going wrong is caught.
+func TestChunkCRC16(t *testing.T) {
+	ctx := context.Background()
+	filename, data := image(t, t.TempDir(), "rom.gb", flashcart.S_32K, 1)
+	d := newer()
+	s, err := flashcart.NewSession(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Link.Features&flashcart.FEATURE_CRC16 == 0 {
+		t.Fatal("CRC16 not negotiated")
+	}
+	d.SetFaults(Faults{Seed: 1, CorruptRate: 1})
+	err = run(func(f chan bool, p chan int64, e chan error) error {
+		return s.WriteFlash(ctx, filename, f, p, e)
+	})
+	var checksum *flashcart.ChecksumError
+	if !errors.As(err, &checksum) {
+		t.Fatalf("got error %v", err)
+	}
+	want := comms.CRC16(data[:s.Link.ChunkSize])
+	if checksum.Chunk != 0 || checksum.Expected != want || checksum.Actual == want {
+		t.Fatalf("got %+v, want a bad echo of 0x%04x", checksum, want)
+	}
+}
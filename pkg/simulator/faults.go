@@ -0,0 +1,95 @@
+package simulator
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+// Faults configures the errors injected by a simulated Device. Rates are
+// probabilities between 0 and 1, drawn from a generator seeded with Seed
+// so a failing run can be reproduced exactly.
+type Faults struct {
+	Seed int64
+
+	// DropRate is the chance of losing each byte sent to the host.
+	DropRate float64
+	// CorruptRate is the chance of a chunk checksum going wrong: the
+	// echo of a programmed chunk is altered, and a read chunk gets a
+	// flipped byte on the wire.
+	CorruptRate float64
+	// DelayRate of the replies are held back by Delay.
+	DelayRate float64
+	Delay     time.Duration
+	// ErrorRate and TimeoutRate are the chances of a status reply being
+	// replaced by STAT_ERROR or STAT_TIMEOUT.
+	ErrorRate   float64
+	TimeoutRate float64
+	// SilentAfter stops all output after that many bytes, as if the
+	// device hung mid transfer. Zero never goes silent.
+	SilentAfter int
+}
+
+type injector struct {
+	faults Faults
+	rand   *rand.Rand
+	sent   int
+}
+
+// SetFaults enables fault injection from the next byte on. The zero
+// Faults turns it off.
+func (d *Device) SetFaults(faults Faults) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inj = injector{faults: faults, rand: rand.New(rand.NewSource(faults.Seed))}
+}
+
+func (inj *injector) hit(rate float64) bool {
+	if rate <= 0 || inj.rand == nil {
+		return false
+	}
+	return inj.rand.Float64() < rate
+}
+
+// drop decides if an output byte is lost.
+func (inj *injector) drop() bool {
+	inj.sent++
+	if inj.faults.SilentAfter > 0 && inj.sent > inj.faults.SilentAfter {
+		return true
+	}
+	return inj.hit(inj.faults.DropRate)
+}
+
+// delay returns when a reply becomes visible to the host.
+func (inj *injector) delay() time.Time {
+	if inj.hit(inj.faults.DelayRate) {
+		return time.Now().Add(inj.faults.Delay)
+	}
+	return time.Now()
+}
+
+func (inj *injector) corrupt(b uint8) uint8 {
+	if inj.hit(inj.faults.CorruptRate) {
+		return b ^ uint8(1+inj.rand.Intn(0xFF))
+	}
+	return b
+}
+
+// corruptChunk flips one byte of a chunk on its way to the host.
+func (inj *injector) corruptChunk(chunk []uint8) {
+	if inj.hit(inj.faults.CorruptRate) {
+		i := inj.rand.Intn(len(chunk))
+		chunk[i] ^= uint8(1 + inj.rand.Intn(0xFF))
+	}
+}
+
+func (inj *injector) status(stat uint8) uint8 {
+	if inj.hit(inj.faults.ErrorRate) {
+		return flashcart.STAT_ERROR
+	}
+	if inj.hit(inj.faults.TimeoutRate) {
+		return flashcart.STAT_TIMEOUT
+	}
+	return stat
+}
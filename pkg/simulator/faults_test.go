@@ -0,0 +1,118 @@
+package simulator
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+// session runs operations on d without waiting long for lost answers.
+func session(d *Device) *flashcart.Session {
+	return &flashcart.Session{Transport: d, Timeout: 50 * time.Millisecond}
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	var checksum *flashcart.ChecksumError
+	tests := []struct {
+		name   string
+		faults Faults
+		op     func(s *flashcart.Session, rom string, dump string) error
+		check  func(err error) bool
+	}{
+		{
+			"dropped bytes",
+			Faults{Seed: 1, DropRate: 1},
+			func(s *flashcart.Session, rom string, dump string) error {
+				_, err := s.Status(ctx)
+				return err
+			},
+			func(err error) bool { return errors.Is(err, comms.ErrTimeout) },
+		},
+		{
+			"corrupted echo",
+			Faults{Seed: 2, CorruptRate: 1},
+			func(s *flashcart.Session, rom string, dump string) error {
+				return run(func(f chan bool, p chan int64, e chan error) error {
+					return s.WriteFlash(ctx, rom, f, p, e)
+				})
+			},
+			func(err error) bool { return errors.As(err, &checksum) && !checksum.Read },
+		},
+		{
+			"corrupted chunk",
+			Faults{Seed: 3, CorruptRate: 1},
+			func(s *flashcart.Session, rom string, dump string) error {
+				return run(func(f chan bool, p chan int64, e chan error) error {
+					return s.ReadFlash(ctx, dump, flashcart.S_32K, f, p, e)
+				})
+			},
+			func(err error) bool { return errors.As(err, &checksum) && checksum.Read },
+		},
+		{
+			"status error",
+			Faults{Seed: 4, ErrorRate: 1},
+			func(s *flashcart.Session, rom string, dump string) error {
+				return s.EraseFlash(ctx)
+			},
+			func(err error) bool { return errors.Is(err, flashcart.ErrDeviceError) },
+		},
+		{
+			"status timeout",
+			Faults{Seed: 5, TimeoutRate: 1},
+			func(s *flashcart.Session, rom string, dump string) error {
+				return s.EraseFlash(ctx)
+			},
+			func(err error) bool { return errors.Is(err, flashcart.ErrDeviceTimeout) },
+		},
+		{
+			"silent mid transfer",
+			Faults{Seed: 6, SilentAfter: 1000},
+			func(s *flashcart.Session, rom string, dump string) error {
+				return run(func(f chan bool, p chan int64, e chan error) error {
+					return s.ReadFlash(ctx, dump, flashcart.S_32K, f, p, e)
+				})
+			},
+			func(err error) bool { return errors.Is(err, comms.ErrTimeout) },
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			rom, _ := image(t, dir, "rom.gb", flashcart.S_32K, int64(i))
+			d := New()
+			d.SetFaults(tt.faults)
+			err := tt.op(session(d), rom, filepath.Join(dir, "dump.gb"))
+			if !tt.check(err) {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
+
+// TestFaultsSeed checks a seed gives the same faults on every run.
+func TestFaultsSeed(t *testing.T) {
+	ctx := context.Background()
+	rom, _ := image(t, t.TempDir(), "rom.gb", flashcart.S_32K, 7)
+	var errs []error
+	for range 2 {
+		d := New()
+		d.SetFaults(Faults{Seed: 42, CorruptRate: 0.05})
+		s := session(d)
+		errs = append(errs, run(func(f chan bool, p chan int64, e chan error) error {
+			return s.WriteFlash(ctx, rom, f, p, e)
+		}))
+	}
+	var checksum *flashcart.ChecksumError
+	if !errors.As(errs[0], &checksum) {
+		t.Fatalf("got error %v", errs[0])
+	}
+	if errs[1] == nil || errs[0].Error() != errs[1].Error() {
+		t.Fatalf("same seed, different runs: %v and %v", errs[0], errs[1])
+	}
+}
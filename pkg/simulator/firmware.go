@@ -0,0 +1,347 @@
+package simulator
+
+import (
+	"slices"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+	"github.com/ladecadence/GBShooperGo/pkg/protocol"
+)
+
+// firmware states
+const (
+	stIdle           = iota // waiting for a command packet
+	stPrgData               // receiving a chunk to program
+	stPrgNext               // chunk programmed, waiting for CMD_PRG_* or CMD_END
+	stReadCheck             // chunk sent, waiting for the host checksum
+	stReadNext              // checksum ok, waiting for CMD_READ_* or CMD_END
+	stEraseRAM              // erasing SRAM, waiting for CMD_ERASE_RAM or CMD_END
+	stConfigBaud            // capabilities sent, waiting for the baud rate
+	stConfigChunk           // waiting for the chunk size
+	stConfigFeatures        // waiting for the features to enable
+	stPrgVerdict            // checksum echoed, waiting for the host verdict
+	stAddress               // waiting for the start address bytes
+)
+
+// header offsets in the cartridge ROM
+const (
+	HEADER_TITLE    = 0x134
+	HEADER_CARTTYPE = 0x147
+	HEADER_ROMSIZE  = 0x148
+	HEADER_RAMSIZE  = 0x149
+)
+
+// firmware mimics the GBShooper microcontroller: it consumes the bytes
+// sent by the host and queues the answers on the Device.
+type firmware struct {
+	state   int
+	command uint8
+	addr    int
+	// start address of the next command, set with CMD_ADDRESS
+	base    int
+	baseLen int
+	packet  []uint8
+	chunk   []uint8
+
+	// link, as set with CMD_CONFIG
+	baudrate  int
+	chunkSize int
+	features  uint8
+	newBaud   int
+	newChunk  int
+
+	// chunk sent to the host and the check received for it
+	sent  []uint8
+	check []uint8
+	// CRC32 of the data transferred by the running command
+	crc uint32
+}
+
+// reset puts the firmware on the power up link.
+func (fw *firmware) reset() {
+	fw.state = stIdle
+	fw.baudrate = flashcart.DEFAULT_BAUDRATE
+	fw.chunkSize = flashcart.BUFFER_SIZE
+	fw.features = 0
+}
+
+func (fw *firmware) input(d *Device, b uint8) {
+	if fw.state == stPrgData {
+		fw.chunk = append(fw.chunk, b)
+		if len(fw.chunk) == fw.chunkSize {
+			fw.program(d)
+		}
+		return
+	}
+
+	fw.packet = append(fw.packet, b)
+	if len(fw.packet) < 2 {
+		return
+	}
+	packet := comms.Packet{Type: fw.packet[0], Data: fw.packet[1]}
+	fw.packet = fw.packet[:0]
+	fw.handle(d, packet)
+}
+
+func (fw *firmware) handle(d *Device, packet comms.Packet) {
+	switch fw.state {
+	case stPrgNext, stReadNext, stEraseRAM:
+		if packet.Type == comms.TYPE_COMMAND && packet.Data == fw.command {
+			fw.next(d)
+			return
+		}
+		if packet.Type == comms.TYPE_COMMAND && packet.Data == comms.CMD_END &&
+			fw.state != stEraseRAM && fw.features&flashcart.FEATURE_CRC32 != 0 {
+			d.reply(comms.TYPE_DATA, uint8(fw.crc>>24), comms.TYPE_DATA, uint8(fw.crc>>16),
+				comms.TYPE_DATA, uint8(fw.crc>>8), comms.TYPE_DATA, uint8(fw.crc))
+		}
+		fw.state = stIdle
+	case stConfigBaud, stConfigChunk, stConfigFeatures:
+		if packet.Type == comms.TYPE_DATA {
+			fw.config(d, packet.Data)
+			return
+		}
+		fw.state = stIdle
+	case stAddress:
+		fw.state = stIdle
+		if packet.Type == comms.TYPE_DATA {
+			fw.base = fw.base<<8 | int(packet.Data)
+			fw.baseLen++
+			if fw.baseLen < protocol.ADDRESS_LEN {
+				fw.state = stAddress
+			} else if !fw.status(d, flashcart.STAT_OK) {
+				fw.base = 0
+			}
+			return
+		}
+		fw.base = 0
+	case stPrgVerdict:
+		if packet.Type == comms.TYPE_STAT && packet.Data == flashcart.STAT_OK {
+			fw.commit(d)
+			return
+		}
+		if packet.Type == comms.TYPE_STAT && packet.Data == flashcart.STAT_RETRY {
+			fw.chunk = fw.chunk[:0]
+			fw.state = stPrgData
+			return
+		}
+		fw.state = stIdle
+	case stReadCheck:
+		fw.state = stIdle
+		if packet.Type == comms.TYPE_DATA {
+			kind := fw.kind()
+			fw.check = append(fw.check, comms.TYPE_DATA, packet.Data)
+			if len(fw.check) < len(kind.Packets(0)) {
+				fw.state = stReadCheck
+				return
+			}
+			if slices.Equal(fw.check, kind.Packets(kind.Compute(fw.sent))) {
+				if fw.status(d, flashcart.STAT_OK) {
+					fw.crc = comms.UpdateCRC32(fw.crc, fw.sent)
+					fw.addr += fw.chunkSize
+					fw.state = stReadNext
+				}
+			} else if fw.features&flashcart.FEATURE_RETRY != 0 {
+				// same chunk again on the next command
+				d.reply(comms.TYPE_STAT, flashcart.STAT_RETRY)
+				fw.state = stReadNext
+			} else {
+				d.reply(comms.TYPE_STAT, comms.CMD_END)
+			}
+			return
+		}
+	}
+
+	switch packet.Type {
+	case comms.TYPE_INFO:
+		d.reply(comms.TYPE_INFO, flashcart.GBS_ID,
+			comms.TYPE_INFO, d.VersionMayor,
+			comms.TYPE_INFO, d.VersionMinor)
+	case comms.TYPE_COMMAND:
+		fw.command = packet.Data
+		// the start address only applies to the command after it
+		fw.addr, fw.base = fw.base, 0
+		fw.crc = 0
+		fw.start(d)
+	default:
+		d.reply(comms.TYPE_STAT, flashcart.STAT_ERROR)
+	}
+}
+
+// start runs a new command from the idle state.
+func (fw *firmware) start(d *Device) {
+	switch fw.command {
+	case comms.CMD_ID:
+		d.reply(comms.TYPE_DATA, d.ManufacturerID,
+			comms.TYPE_DATA, d.ChipID)
+	case comms.CMD_READ_HEADER:
+		d.reply(comms.TYPE_DATA, mirror(d.Flash, HEADER_CARTTYPE),
+			comms.TYPE_DATA, mirror(d.Flash, HEADER_ROMSIZE),
+			comms.TYPE_DATA, mirror(d.Flash, HEADER_RAMSIZE))
+		for i := range 16 {
+			d.reply(comms.TYPE_DATA, mirror(d.Flash, HEADER_TITLE+i))
+		}
+	case comms.CMD_ERASE_FLASH:
+		if fw.status(d, flashcart.STAT_OK) {
+			for i := range d.Flash {
+				d.Flash[i] = 0xFF
+			}
+		}
+	case comms.CMD_PRG_FLASH, comms.CMD_PRG_RAM, comms.CMD_ERASE_RAM:
+		if fw.status(d, flashcart.STAT_OK) {
+			fw.next(d)
+		}
+	case comms.CMD_READ_FLASH, comms.CMD_READ_RAM:
+		fw.next(d)
+	case comms.CMD_CONFIG:
+		if !(flashcart.Status{VersionMayor: d.VersionMayor, VersionMinor: d.VersionMinor}).AtLeast(flashcart.CONFIG_VERSION) {
+			d.reply(comms.TYPE_STAT, flashcart.STAT_ERROR)
+			return
+		}
+		var bauds uint8 = 0
+		for _, b := range flashcart.Baudrates {
+			if slices.Contains(d.Baudrates, b.Rate) {
+				bauds |= b.ID
+			}
+		}
+		d.reply(comms.TYPE_DATA, bauds,
+			comms.TYPE_DATA, uint8(d.MaxChunk/flashcart.BUFFER_SIZE),
+			comms.TYPE_DATA, d.Features)
+		fw.state = stConfigBaud
+	case comms.CMD_ADDRESS:
+		if fw.features&flashcart.FEATURE_ADDRESS == 0 {
+			d.reply(comms.TYPE_STAT, flashcart.STAT_ERROR)
+			return
+		}
+		fw.baseLen = 0
+		fw.state = stAddress
+	case comms.CMD_END:
+		fw.state = stIdle
+	default:
+		d.reply(comms.TYPE_STAT, flashcart.STAT_ERROR)
+	}
+}
+
+// config takes the baud rate, the chunk size and the features of
+// CMD_CONFIG. The answer goes out at the old speed, the new link is used
+// after it.
+func (fw *firmware) config(d *Device, data uint8) {
+	switch fw.state {
+	case stConfigBaud:
+		fw.newBaud = 0
+		for _, b := range flashcart.Baudrates {
+			if b.ID == data && slices.Contains(d.Baudrates, b.Rate) {
+				fw.newBaud = b.Rate
+			}
+		}
+		fw.state = stConfigChunk
+		return
+	case stConfigChunk:
+		fw.newChunk = int(data) * flashcart.BUFFER_SIZE
+		fw.state = stConfigFeatures
+		return
+	}
+
+	fw.state = stIdle
+	if fw.newBaud == 0 || fw.newChunk == 0 || fw.newChunk > d.MaxChunk || data&^d.Features != 0 {
+		d.reply(comms.TYPE_STAT, flashcart.STAT_ERROR)
+		return
+	}
+	if fw.status(d, flashcart.STAT_OK) {
+		fw.baudrate = fw.newBaud
+		fw.chunkSize = fw.newChunk
+		fw.features = data
+	}
+}
+
+// next processes the following chunk of a multi chunk command.
+func (fw *firmware) next(d *Device) {
+	switch fw.command {
+	case comms.CMD_PRG_FLASH, comms.CMD_PRG_RAM:
+		fw.chunk = fw.chunk[:0]
+		fw.state = stPrgData
+	case comms.CMD_READ_FLASH, comms.CMD_READ_RAM:
+		mem := fw.memory(d)
+		fw.sent = fw.sent[:0]
+		for i := range fw.chunkSize {
+			fw.sent = append(fw.sent, mirror(mem, fw.addr+i))
+		}
+		chunk := slices.Clone(fw.sent)
+		d.inj.corruptChunk(chunk)
+		d.reply(chunk...)
+		fw.check = fw.check[:0]
+		fw.state = stReadCheck
+	case comms.CMD_ERASE_RAM:
+		for i := range flashcart.BUFFER_SIZE {
+			d.RAM[(fw.addr+i)%len(d.RAM)] = 0x00
+		}
+		fw.addr += flashcart.BUFFER_SIZE
+		if fw.status(d, flashcart.STAT_OK) {
+			fw.state = stEraseRAM
+		}
+	}
+}
+
+// program echoes the checksum of a received chunk and stores it, after
+// the host verdict with FEATURE_RETRY.
+func (fw *firmware) program(d *Device) {
+	echo := fw.kind().Packets(fw.kind().Compute(fw.chunk))
+	echo[len(echo)-1] = d.inj.corrupt(echo[len(echo)-1])
+	d.reply(echo...)
+	if fw.features&flashcart.FEATURE_RETRY != 0 {
+		fw.state = stPrgVerdict
+		return
+	}
+	fw.commit(d)
+}
+
+// commit stores the received chunk. Flash cells can only be cleared, so
+// unerased flash keeps its zero bits.
+func (fw *firmware) commit(d *Device) {
+	mem := fw.memory(d)
+	for i, b := range fw.chunk {
+		a := (fw.addr + i) % len(mem)
+		if fw.command == comms.CMD_PRG_FLASH {
+			mem[a] &= b
+		} else {
+			mem[a] = b
+		}
+	}
+	fw.crc = comms.UpdateCRC32(fw.crc, fw.chunk)
+	fw.addr += fw.chunkSize
+	fw.state = stPrgNext
+}
+
+// status sends a status reply, which fault injection may turn into an
+// error. The firmware gives up the command unless the reply is stat.
+func (fw *firmware) status(d *Device, stat uint8) bool {
+	reply := d.inj.status(stat)
+	d.reply(comms.TYPE_STAT, reply)
+	if reply != stat {
+		fw.state = stIdle
+		return false
+	}
+	return true
+}
+
+// kind is the chunk check in use, CRC16 once enabled.
+func (fw *firmware) kind() comms.ChunkCheck {
+	if fw.features&flashcart.FEATURE_CRC16 != 0 {
+		return comms.CHECK_CRC16
+	}
+	return comms.CHECK_SUM
+}
+
+func (fw *firmware) memory(d *Device) []uint8 {
+	switch fw.command {
+	case comms.CMD_READ_RAM, comms.CMD_PRG_RAM, comms.CMD_ERASE_RAM:
+		return d.RAM
+	}
+	return d.Flash
+}
+
+// mirror reads memory like the cart bus does, wrapping addresses past
+// the end of the chip.
+func mirror(mem []uint8, addr int) uint8 {
+	return mem[addr%len(mem)]
+}
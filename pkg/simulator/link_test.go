@@ -0,0 +1,177 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+// newer is a simulated GBShooper with firmware answering CMD_CONFIG, at
+// up to 1M baud with 4096 byte chunks and all the features.
+func newer() *Device {
+	d := New()
+	d.VersionMinor = '1'
+	d.Baudrates = []int{comms.BAUDRATE_115_2K, comms.BAUDRATE_230_4K, comms.BAUDRATE_1M}
+	d.MaxChunk = flashcart.MAX_CHUNK_SIZE
+	d.Features = flashcart.FEATURES
+	return d
+}
+
+func TestNegotiate(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		device *Device
+		link   flashcart.Link
+	}{
+		{"old firmware", New(), flashcart.DefaultLink},
+		{"new firmware", newer(), flashcart.Link{Baudrate: comms.BAUDRATE_1M, ChunkSize: flashcart.MAX_CHUNK_SIZE, Features: flashcart.FEATURES}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := flashcart.NewSession(ctx, tt.device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Link != tt.link {
+				t.Fatalf("negotiated %+v, want %+v", s.Link, tt.link)
+			}
+			// still answering on the new link
+			if _, err := s.Status(ctx); err != nil {
+				t.Fatal(err)
+			}
+			// and back on DefaultLink after closing
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			fw := tt.device.fw
+			if fw.baudrate != flashcart.DEFAULT_BAUDRATE || fw.chunkSize != flashcart.BUFFER_SIZE || fw.features != 0 {
+				t.Fatalf("left at %d baud, %d byte chunks, features 0x%02x", fw.baudrate, fw.chunkSize, fw.features)
+			}
+		})
+	}
+}
+
+// lossy loses the first answers read at 1M baud, as a cable not quite
+// up to it would.
+type lossy struct {
+	*Device
+	baudrate int
+	drop     int
+}
+
+func (l *lossy) SetBaudrate(baudrate int) error {
+	l.baudrate = baudrate
+	return l.Device.SetBaudrate(baudrate)
+}
+
+func (l *lossy) lose() bool {
+	if l.baudrate == comms.BAUDRATE_1M && l.drop > 0 {
+		l.drop--
+		return true
+	}
+	return false
+}
+
+func (l *lossy) ReceivePacket(timeout time.Duration) (comms.Packet, error) {
+	if l.lose() {
+		return comms.Packet{}, comms.ErrTimeout
+	}
+	return l.Device.ReceivePacket(timeout)
+}
+
+func (l *lossy) ReceiveBuffer(buffer []uint8, timeout time.Duration) error {
+	if l.lose() {
+		return comms.ErrTimeout
+	}
+	return l.Device.ReceiveBuffer(buffer, timeout)
+}
+
+// TestNegotiateFallback fails the check of the faster link, and expects
+// the session to go on with the device back on DefaultLink.
+func TestNegotiateFallback(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		drop int
+	}{
+		// CMD_CONFIG on the new link puts it back
+		{"first answer lost", 1},
+		// and if that is lost too, GBSRecover
+		{"answers lost", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newer()
+			s := session(d)
+			s.Transport = &lossy{Device: d, baudrate: flashcart.DEFAULT_BAUDRATE, drop: tt.drop}
+			status, err := s.Status(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Version = status
+			if _, err := s.Negotiate(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if s.Link != flashcart.DefaultLink {
+				t.Fatalf("session on %+v", s.Link)
+			}
+			fw := d.fw
+			if fw.baudrate != flashcart.DEFAULT_BAUDRATE || fw.chunkSize != flashcart.BUFFER_SIZE || fw.features != 0 {
+				t.Fatalf("device left at %d baud, %d byte chunks, features 0x%02x", fw.baudrate, fw.chunkSize, fw.features)
+			}
+			if _, err := s.Status(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestSmallRAM writes whole saves to RAMs smaller than a chunk, which
+// mirror their addresses.
+func TestSmallRAM(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		device func() *Device
+		size   int
+	}{
+		{"old firmware MBC2", New, flashcart.S_512},
+		{"old firmware 2KB", New, flashcart.S_2K},
+		{"new firmware MBC2", newer, flashcart.S_512},
+		{"new firmware 2KB", newer, flashcart.S_2K},
+		{"new firmware 8KB", newer, flashcart.S_8K},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename, data := image(t, t.TempDir(), "game.sav", tt.size, int64(i))
+			d := tt.device()
+			d.RAM = make([]uint8, tt.size)
+			s, err := flashcart.NewSession(ctx, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link := s.Link
+
+			err = run(func(f chan bool, p chan int64, e chan error) error {
+				return s.WriteRAM(ctx, filename, f, p, e)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d.RAM, data) {
+				t.Fatal("RAM differs from the save written")
+			}
+			if s.Link != link {
+				t.Fatalf("link left at %+v, was %+v", s.Link, link)
+			}
+			if _, err := s.Status(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
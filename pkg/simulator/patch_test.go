@@ -0,0 +1,54 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+func TestWriteFlashAt(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	patch, data := image(t, dir, "patch.bin", flashcart.ROM_BANK_SIZE, 1)
+	empty, _ := image(t, dir, "empty.bin", 0, 0)
+	tests := []struct {
+		name     string
+		filename string
+		offset   int64
+		// programmed before the patch
+		used int
+		err  error
+	}{
+		{"second bank", patch, flashcart.ROM_BANK_SIZE, 0, nil},
+		{"last bank", patch, flashcart.S_2MB - flashcart.ROM_BANK_SIZE, 0, nil},
+		{"empty file", empty, flashcart.ROM_BANK_SIZE, 0, flashcart.ErrEmptyFile},
+		{"not erased", patch, flashcart.ROM_BANK_SIZE, flashcart.ROM_BANK_SIZE + 100, flashcart.ErrNotErased},
+		{"past the chip", patch, flashcart.S_2MB - 100, 0, flashcart.ErrOutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newer()
+			d.Flash[tt.used] = 0x00
+			before := bytes.Clone(d.Flash)
+			s, err := flashcart.NewSession(ctx, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = run(func(f chan bool, p chan int64, e chan error) error {
+				return s.WriteFlashAt(ctx, tt.filename, tt.offset, f, p, e)
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.err == nil {
+				copy(before[tt.offset:], data)
+			}
+			if !bytes.Equal(d.Flash, before) {
+				t.Fatal("flash differs from the expected")
+			}
+		})
+	}
+}
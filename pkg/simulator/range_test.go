@@ -0,0 +1,99 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+// TestReadRange reads parts of the flash and the RAM, which wrap past the
+// end of the chip like on the cart bus.
+func TestReadRange(t *testing.T) {
+	ctx := context.Background()
+	d := newer()
+	rand.New(rand.NewSource(1)).Read(d.Flash)
+	rand.New(rand.NewSource(2)).Read(d.RAM)
+	s, err := flashcart.NewSession(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		ram    bool
+		offset int64
+		length int64
+		want   []uint8
+	}{
+		{"ROM bank 3", false, 3 * flashcart.ROM_BANK_SIZE, flashcart.ROM_BANK_SIZE,
+			d.Flash[3*flashcart.ROM_BANK_SIZE : 4*flashcart.ROM_BANK_SIZE]},
+		{"in ROM bank 3", false, 3*flashcart.ROM_BANK_SIZE + 0x100, 16,
+			d.Flash[3*flashcart.ROM_BANK_SIZE+0x100 : 3*flashcart.ROM_BANK_SIZE+0x110]},
+		{"RAM bank 1", true, flashcart.RAM_BANK_SIZE, flashcart.RAM_BANK_SIZE,
+			d.RAM[flashcart.RAM_BANK_SIZE : 2*flashcart.RAM_BANK_SIZE]},
+		{"in RAM bank 1", true, flashcart.RAM_BANK_SIZE + 0x100, 16,
+			d.RAM[flashcart.RAM_BANK_SIZE+0x100 : flashcart.RAM_BANK_SIZE+0x110]},
+		{"past the end of the ROM", false, FLASH_SIZE - 100, 300,
+			append(bytes.Clone(d.Flash[FLASH_SIZE-100:]), d.Flash[:200]...)},
+		{"past the end of the RAM", true, RAM_SIZE - 100, 300,
+			append(bytes.Clone(d.RAM[RAM_SIZE-100:]), d.RAM[:200]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dump := filepath.Join(t.TempDir(), "dump.bin")
+			err := run(func(f chan bool, p chan int64, e chan error) error {
+				if tt.ram {
+					return s.ReadRAMRange(ctx, dump, tt.offset, tt.length, f, p, e)
+				}
+				return s.ReadFlashRange(ctx, dump, tt.offset, tt.length, f, p, e)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := os.ReadFile(dump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(read, tt.want) {
+				t.Fatalf("read %d bytes differing from the range", len(read))
+			}
+		})
+	}
+}
+
+// TestReadRangeNoAddress checks firmware without FEATURE_ADDRESS only
+// reads from the start.
+func TestReadRangeNoAddress(t *testing.T) {
+	ctx := context.Background()
+	d := New()
+	rand.New(rand.NewSource(1)).Read(d.RAM)
+	s := session(d)
+	dump := filepath.Join(t.TempDir(), "dump.bin")
+
+	err := run(func(f chan bool, p chan int64, e chan error) error {
+		return s.ReadRAMRange(ctx, dump, flashcart.RAM_BANK_SIZE, 16, f, p, e)
+	})
+	if !errors.Is(err, flashcart.ErrNoAddress) {
+		t.Fatalf("got error %v", err)
+	}
+	err = run(func(f chan bool, p chan int64, e chan error) error {
+		return s.ReadRAMRange(ctx, dump, 0, 16, f, p, e)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, d.RAM[:16]) {
+		t.Fatal("read differs from the start of the RAM")
+	}
+}
@@ -0,0 +1,100 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+// TestRecoverPartialChunk leaves a write with half a chunk sent, and
+// checks recovery completes it with 0xFF and tells so. The handshake
+// tried first ends up in the chunk too.
+func TestRecoverPartialChunk(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		command uint8
+		memory  func(d *Device) []uint8
+	}{
+		{"RAM", comms.CMD_PRG_RAM, func(d *Device) []uint8 { return d.RAM }},
+		{"flash", comms.CMD_PRG_FLASH, func(d *Device) []uint8 { return d.Flash }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New()
+			mem := tt.memory(d)
+			before := bytes.Clone(mem)
+
+			// interrupted after 100 bytes of the first chunk
+			d.SendPacket(comms.Packet{Type: comms.TYPE_COMMAND, Data: tt.command})
+			data := bytes.Repeat([]uint8{0x5A}, 100)
+			d.SendBuffer(data)
+
+			rec, err := flashcart.GBSRecover(ctx, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !rec.Committed {
+				t.Fatal("committed chunk not reported")
+			}
+			if !bytes.Equal(mem[:100], data) {
+				t.Fatal("data sent before the interruption not programmed")
+			}
+			handshake := []uint8{comms.TYPE_INFO, 0x00}
+			if !bytes.Equal(mem[100:102], handshake) {
+				t.Fatalf("handshake reads % x", mem[100:102])
+			}
+			if !bytes.Equal(mem[102:flashcart.BUFFER_SIZE], bytes.Repeat([]uint8{0xFF}, flashcart.BUFFER_SIZE-102)) {
+				t.Fatalf("rest of the chunk reads % x...", mem[102:108])
+			}
+			if !bytes.Equal(mem[flashcart.BUFFER_SIZE:], before[flashcart.BUFFER_SIZE:]) {
+				t.Fatal("memory past the chunk changed")
+			}
+		})
+	}
+}
+
+// counted counts the bytes sent to the device.
+type counted struct {
+	*Device
+	sent int
+}
+
+func (c *counted) SendBuffer(buffer []uint8) error {
+	c.sent += len(buffer)
+	return c.Device.SendBuffer(buffer)
+}
+
+func (c *counted) SendPacket(packet comms.Packet) error {
+	c.sent += 2
+	return c.Device.SendPacket(packet)
+}
+
+func (c *counted) SendByte(data uint8) error {
+	c.sent++
+	return c.Device.SendByte(data)
+}
+
+// TestRecoverIdle checks an idle device only gets the handshake.
+func TestRecoverIdle(t *testing.T) {
+	ctx := context.Background()
+	d := New()
+	ram := bytes.Clone(d.RAM)
+	c := &counted{Device: d}
+	rec, err := flashcart.GBSRecover(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Committed || rec.Drained != 0 || rec.Ends != 0 {
+		t.Fatalf("idle device recovered with %+v", rec)
+	}
+	if c.sent != 2 {
+		t.Fatalf("idle device sent %d bytes, not just the handshake", c.sent)
+	}
+	if !bytes.Equal(d.RAM, ram) {
+		t.Fatal("RAM changed")
+	}
+}
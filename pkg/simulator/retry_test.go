@@ -0,0 +1,125 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		newer  bool
+		read   bool
+		faults Faults
+		retry  flashcart.RetryPolicy
+		// attempts of the failing chunk, 0 when it gets through
+		attempts int
+	}{
+		{"write", true, false, Faults{Seed: 1, CorruptRate: 0.2}, flashcart.RetryPolicy{Attempts: 5}, 0},
+		{"read", true, true, Faults{Seed: 2, CorruptRate: 0.2}, flashcart.RetryPolicy{Attempts: 5}, 0},
+		{"read, old firmware starts over", false, true, Faults{Seed: 3, CorruptRate: 0.01}, flashcart.RetryPolicy{Attempts: 5}, 0},
+		{"write, old firmware", false, false, Faults{Seed: 4, CorruptRate: 0.2}, flashcart.RetryPolicy{Attempts: 5}, 1},
+		{"attempt limit", true, false, Faults{Seed: 5, CorruptRate: 1}, flashcart.RetryPolicy{Attempts: 2}, 3},
+		{"attempt limit, read", true, true, Faults{Seed: 6, CorruptRate: 1}, flashcart.RetryPolicy{Attempts: 2}, 3},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename, data := image(t, dir, "rom.gb", flashcart.S_32K, int64(i))
+			dump := filepath.Join(dir, "dump.gb")
+			d := New()
+			s := session(d)
+			if tt.newer {
+				d = newer()
+				var err error
+				s, err = flashcart.NewSession(ctx, d)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.Timeout = 50 * time.Millisecond
+			}
+			if tt.read {
+				copy(d.Flash, data)
+			}
+			s.Retry = tt.retry
+			d.SetFaults(tt.faults)
+
+			err := run(func(f chan bool, p chan int64, e chan error) error {
+				if tt.read {
+					return s.ReadFlash(ctx, dump, flashcart.S_32K, f, p, e)
+				}
+				return s.WriteFlash(ctx, filename, f, p, e)
+			})
+			if tt.attempts > 0 {
+				var checksum *flashcart.ChecksumError
+				if !errors.As(err, &checksum) || checksum.Attempts != tt.attempts || checksum.Read != tt.read {
+					t.Fatalf("got error %v", err)
+				}
+				if s.Retries != tt.attempts-1 {
+					t.Fatalf("%d retries counted, want %d", s.Retries, tt.attempts-1)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Retries == 0 {
+				t.Fatal("no retries counted")
+			}
+			got := d.Flash[:flashcart.S_32K]
+			if tt.read {
+				got, err = os.ReadFile(dump)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("data differs after the retries")
+			}
+		})
+	}
+}
+
+// TestRetryBackoff checks the wait before each retry doubles.
+func TestRetryBackoff(t *testing.T) {
+	ctx := context.Background()
+	filename, _ := image(t, t.TempDir(), "rom.gb", flashcart.S_32K, 1)
+	d := newer()
+	s, err := flashcart.NewSession(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Retry = flashcart.RetryPolicy{Attempts: 3, Backoff: 20 * time.Millisecond}
+	d.SetFaults(Faults{Seed: 1, CorruptRate: 1})
+	start := time.Now()
+	err = run(func(f chan bool, p chan int64, e chan error) error {
+		return s.WriteFlash(ctx, filename, f, p, e)
+	})
+	var checksum *flashcart.ChecksumError
+	if !errors.As(err, &checksum) {
+		t.Fatalf("got error %v", err)
+	}
+	// 20, 40 and 80ms
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+
+	// cancelled while waiting
+	s.Retry.Backoff = time.Hour
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err = run(func(f chan bool, p chan int64, e chan error) error {
+		return s.WriteFlash(cctx, filename, f, p, e)
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v", err)
+	}
+}
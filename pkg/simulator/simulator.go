@@ -0,0 +1,249 @@
+package simulator
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+const (
+	FLASH_SIZE = flashcart.S_2MB
+	RAM_SIZE   = flashcart.S_128K
+)
+
+// Device is a software GBShooper. It implements comms.Transport and runs
+// the firmware side of the packet protocol against in-memory flash and
+// SRAM images, which can be loaded from and saved back to files.
+type Device struct {
+	Flash          []uint8
+	RAM            []uint8
+	VersionMayor   uint8
+	VersionMinor   uint8
+	ManufacturerID uint8
+	ChipID         uint8
+
+	// Baudrates, MaxChunk and Features are advertised on CMD_CONFIG,
+	// which only firmware from flashcart.CONFIG_VERSION on answers.
+	Baudrates []int
+	MaxChunk  int
+	Features  uint8
+
+	FlashFile string
+	RAMFile   string
+
+	mu     sync.Mutex
+	notify chan struct{}
+	out    []pending
+	fw     firmware
+	inj    injector
+	closed bool
+	// host side speed, bytes only get through when it matches the firmware
+	baudrate int
+}
+
+// pending is a byte on its way to the host.
+type pending struct {
+	data     uint8
+	at       time.Time
+	baudrate int
+}
+
+// New returns a simulated GBShooper with an erased AM29F016 flash chip
+// and a cleared 128KB SRAM.
+func New() *Device {
+	d := &Device{
+		Flash:          make([]uint8, FLASH_SIZE),
+		RAM:            make([]uint8, RAM_SIZE),
+		VersionMayor:   '1',
+		VersionMinor:   '0',
+		ManufacturerID: 0x01,
+		ChipID:         0xAD,
+		Baudrates:      []int{flashcart.DEFAULT_BAUDRATE},
+		MaxChunk:       flashcart.BUFFER_SIZE,
+		notify:         make(chan struct{}, 1),
+		baudrate:       flashcart.DEFAULT_BAUDRATE,
+	}
+	d.fw.reset()
+	for i := range d.Flash {
+		d.Flash[i] = 0xFF
+	}
+	return d
+}
+
+// Open returns a simulated GBShooper backed by the flash and SRAM image
+// files. Missing files start as blank chips, and both images are written
+// back on Close. An empty filename keeps that image in memory only.
+func Open(flashFile string, ramFile string) (*Device, error) {
+	d := New()
+	d.FlashFile = flashFile
+	d.RAMFile = ramFile
+
+	var err error
+	d.Flash, err = load(flashFile, d.Flash)
+	if err != nil {
+		return nil, err
+	}
+	d.RAM, err = load(ramFile, d.RAM)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func load(filename string, image []uint8) ([]uint8, error) {
+	if filename == "" {
+		return image, nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return image, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > len(image) {
+		image = append(image, make([]uint8, len(data)-len(image))...)
+	}
+	copy(image, data)
+	return image, nil
+}
+
+func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	if d.FlashFile != "" {
+		if err := os.WriteFile(d.FlashFile, d.Flash, 0644); err != nil {
+			return err
+		}
+	}
+	if d.RAMFile != "" {
+		if err := os.WriteFile(d.RAMFile, d.RAM, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetBaudrate changes the host side speed. Until the firmware runs at the
+// same one, whatever is sent either way is lost.
+func (d *Device) SetBaudrate(baudrate int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.baudrate = baudrate
+	return nil
+}
+
+func (d *Device) Purge() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.out = d.out[:0]
+	return nil
+}
+
+func (d *Device) SendByte(data uint8) error {
+	return d.SendBuffer([]uint8{data})
+}
+
+func (d *Device) SendPacket(packet comms.Packet) error {
+	return d.SendBuffer([]uint8{packet.Type, packet.Data})
+}
+
+func (d *Device) SendBuffer(buffer []uint8) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return comms.ErrClosed
+	}
+	if d.baudrate != d.fw.baudrate {
+		return nil
+	}
+	for _, b := range buffer {
+		d.fw.input(d, b)
+	}
+	return nil
+}
+
+func (d *Device) ReceiveByte(timeout time.Duration) (uint8, error) {
+	var data []uint8 = make([]uint8, 1)
+	err := d.receive(data, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return data[0], nil
+}
+
+func (d *Device) ReceivePacket(timeout time.Duration) (comms.Packet, error) {
+	var data []uint8 = make([]uint8, 2)
+	err := d.receive(data, timeout)
+	if err != nil {
+		return comms.Packet{}, err
+	}
+	return comms.Packet{Type: data[0], Data: data[1]}, nil
+}
+
+func (d *Device) ReceiveBuffer(buffer []uint8, timeout time.Duration) error {
+	return d.receive(buffer, timeout)
+}
+
+// receive fills data from the device output, waiting up to timeout.
+func (d *Device) receive(data []uint8, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	received := 0
+	for {
+		d.mu.Lock()
+		if d.closed {
+			d.mu.Unlock()
+			return comms.Partial(data[:received], comms.ErrClosed)
+		}
+		now := time.Now()
+		for received < len(data) && len(d.out) > 0 && !d.out[0].at.After(now) {
+			if d.out[0].baudrate == d.baudrate {
+				data[received] = d.out[0].data
+				received++
+			}
+			d.out = d.out[1:]
+		}
+		// wake up when a delayed byte is due
+		var due <-chan time.Time
+		if len(d.out) > 0 {
+			due = time.After(d.out[0].at.Sub(now))
+		}
+		d.mu.Unlock()
+
+		if received == len(data) {
+			return nil
+		}
+
+		select {
+		case <-d.notify:
+		case <-due:
+		case <-deadline.C:
+			return comms.Partial(data[:received], comms.ErrTimeout)
+		}
+	}
+}
+
+// reply queues bytes for the host, called by the firmware with the lock held.
+func (d *Device) reply(data ...uint8) {
+	at := d.inj.delay()
+	for _, b := range data {
+		if !d.inj.drop() {
+			d.out = append(d.out, pending{b, at, d.fw.baudrate})
+		}
+	}
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,213 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+// run calls op with channels no one waits on, as the CLI would.
+func run(op func(finished chan bool, progress chan int64, errchan chan error) error) error {
+	progress := make(chan int64)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-progress:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return op(make(chan bool, 1), progress, make(chan error, 1))
+}
+
+// image writes size random bytes to a file in dir.
+func image(t *testing.T, dir string, name string, size int, seed int64) (string, []uint8) {
+	data := make([]uint8, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename, data
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		ram  bool
+		size int
+		// what an erased chip reads
+		erased uint8
+	}{
+		{"flash 32KB", false, flashcart.S_32K, 0xFF},
+		{"flash odd size", false, 1000, 0xFF},
+		{"RAM 8KB", true, flashcart.S_8K, 0x00},
+		{"RAM odd size", true, 1000, 0x00},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename, data := image(t, dir, "image.bin", tt.size, int64(i))
+			dump := filepath.Join(dir, "dump.bin")
+			d := New()
+
+			// write and read back
+			err := run(func(f chan bool, p chan int64, e chan error) error {
+				if tt.ram {
+					return flashcart.GBSWriteRAM(ctx, d, filename, f, p, e)
+				}
+				return flashcart.GBSWriteFlash(ctx, d, filename, f, p, e)
+			})
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			err = run(func(f chan bool, p chan int64, e chan error) error {
+				if tt.ram {
+					return flashcart.GBSReadRAM(ctx, d, dump, int64(tt.size), f, p, e)
+				}
+				return flashcart.GBSReadFlash(ctx, d, dump, int64(tt.size), f, p, e)
+			})
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			read, err := os.ReadFile(dump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(read, data) {
+				t.Fatalf("read back differs from the image written")
+			}
+
+			// erase and read back
+			err = run(func(f chan bool, p chan int64, e chan error) error {
+				if tt.ram {
+					return flashcart.GBSEraseRAM(ctx, d, flashcart.S_32K, f, p, e)
+				}
+				return flashcart.GBSEraseFlash(ctx, d)
+			})
+			if err != nil {
+				t.Fatalf("erase: %v", err)
+			}
+			err = run(func(f chan bool, p chan int64, e chan error) error {
+				if tt.ram {
+					return flashcart.GBSReadRAM(ctx, d, dump, int64(tt.size), f, p, e)
+				}
+				return flashcart.GBSReadFlash(ctx, d, dump, int64(tt.size), f, p, e)
+			})
+			if err != nil {
+				t.Fatalf("read erased: %v", err)
+			}
+			read, err = os.ReadFile(dump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(read, bytes.Repeat([]uint8{tt.erased}, tt.size)) {
+				t.Fatalf("erased chip doesn't read 0x%02x", tt.erased)
+			}
+		})
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	ctx := context.Background()
+	d := New()
+	status, err := flashcart.GBSStatus(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != (flashcart.Status{VersionMayor: '1', VersionMinor: '0'}) {
+		t.Fatalf("version %c.%c", status.VersionMayor, status.VersionMinor)
+	}
+	id, err := flashcart.GBSChipID(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Chip != "AM29F016" {
+		t.Fatalf("chip %q", id.Chip)
+	}
+}
+
+func TestEmptyFile(t *testing.T) {
+	ctx := context.Background()
+	filename, _ := image(t, t.TempDir(), "empty.gb", 0, 0)
+	d := New()
+	err := run(func(f chan bool, p chan int64, e chan error) error {
+		return flashcart.GBSWriteFlash(ctx, d, filename, f, p, e)
+	})
+	if !errors.Is(err, flashcart.ErrEmptyFile) {
+		t.Fatalf("got error %v", err)
+	}
+	// the device is still listening
+	if _, err := flashcart.GBSStatus(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOpen loads the images from files, writes through a session and
+// checks Close saves them for the next Open.
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	flash, data := image(t, dir, "flash.bin", 1000, 1)
+	ram := filepath.Join(dir, "ram.bin")
+	save, saved := image(t, dir, "save.sav", flashcart.S_8K, 2)
+
+	d, err := Open(flash, ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Flash) != FLASH_SIZE || !bytes.Equal(d.Flash[:1000], data) {
+		t.Fatal("flash image not loaded")
+	}
+	if !bytes.Equal(d.Flash[1000:], bytes.Repeat([]uint8{0xFF}, FLASH_SIZE-1000)) {
+		t.Fatal("rest of the flash not erased")
+	}
+	if !bytes.Equal(d.RAM, make([]uint8, RAM_SIZE)) {
+		t.Fatal("missing RAM image not cleared")
+	}
+
+	s, err := flashcart.NewSession(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run(func(f chan bool, p chan int64, e chan error) error {
+		return s.WriteRAM(ctx, save, f, p, e)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open(flash, ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Flash) != FLASH_SIZE || !bytes.Equal(d.Flash[:1000], data) {
+		t.Fatal("flash image not saved")
+	}
+	if len(d.RAM) != RAM_SIZE || !bytes.Equal(d.RAM[:flashcart.S_8K], saved) {
+		t.Fatal("RAM written not saved")
+	}
+
+	// images larger than the chip are kept whole, bad paths fail
+	big, data := image(t, dir, "big.bin", FLASH_SIZE+10, 3)
+	d, err = Open(big, "")
+	if err != nil || !bytes.Equal(d.Flash, data) {
+		t.Fatalf("large image not loaded: %v", err)
+	}
+	if _, err := Open(dir, ""); err == nil {
+		t.Fatal("directory loaded as an image")
+	}
+}
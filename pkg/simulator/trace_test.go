@@ -0,0 +1,124 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ladecadence/GBShooperGo/pkg/comms"
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+// traced negotiates with gbs, writes rom and reads it back into dump.
+func traced(gbs comms.Transport, rom string, dump string) error {
+	ctx := context.Background()
+	s, err := flashcart.NewSession(ctx, gbs)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = run(func(f chan bool, p chan int64, e chan error) error {
+		return s.WriteFlash(ctx, rom, f, p, e)
+	})
+	if err != nil {
+		return err
+	}
+	return run(func(f chan bool, p chan int64, e chan error) error {
+		return s.ReadFlash(ctx, dump, flashcart.S_32K, f, p, e)
+	})
+}
+
+func TestTraceReplay(t *testing.T) {
+	dir := t.TempDir()
+	rom, data := image(t, dir, "rom.gb", flashcart.S_32K, 1)
+	other, _ := image(t, dir, "other.gb", flashcart.S_32K, 2)
+	trace := filepath.Join(dir, "trace.txt")
+
+	// record
+	file, err := os.Create(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = traced(comms.NewTracer(newer(), file), rom, filepath.Join(dir, "dump.gb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]uint8{0}); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("trace file left open: %v", err)
+	}
+
+	// the same operations play back without the device
+	replay := func() *comms.Replay {
+		file, err := os.Open(trace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		rp, err := comms.OpenReplay(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rp
+	}
+	dump := filepath.Join(dir, "replayed.gb")
+	err = traced(replay(), rom, dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("replayed dump differs from the recorded one")
+	}
+
+	// and other ones diverge
+	var diverged *comms.ReplayError
+	err = traced(replay(), other, dump)
+	if !errors.As(err, &diverged) {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+// TestTracePartial checks a receive getting only some of the bytes is
+// recorded with them, and replayed the same.
+func TestTracePartial(t *testing.T) {
+	answer := []uint8{comms.TYPE_INFO, flashcart.GBS_ID, comms.TYPE_INFO, '1', comms.TYPE_INFO, '0'}
+	receive := func(gbs comms.Transport) {
+		t.Helper()
+		if err := gbs.SendPacket(comms.Packet{Type: comms.TYPE_INFO}); err != nil {
+			t.Fatal(err)
+		}
+		// the answer is 2 bytes short
+		buffer := make([]uint8, len(answer)+2)
+		err := gbs.ReceiveBuffer(buffer, 50*time.Millisecond)
+		var short *comms.PartialError
+		if !errors.As(err, &short) || !errors.Is(err, comms.ErrTimeout) {
+			t.Fatalf("got error %v", err)
+		}
+		if !bytes.Equal(short.Data, answer) {
+			t.Fatalf("got % x, want % x", short.Data, answer)
+		}
+	}
+
+	var trace bytes.Buffer
+	receive(comms.NewTracer(New(), &trace))
+	if !strings.Contains(trace.String(), "< 44 17 44 31 44 30\n") {
+		t.Fatalf("partial answer not recorded:\n%s", trace.String())
+	}
+
+	rp, err := comms.OpenReplay(&trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(rp)
+	if _, err := rp.ReceivePacket(time.Millisecond); !errors.Is(err, comms.ErrTraceEnd) {
+		t.Fatalf("failure replayed twice: %v", err)
+	}
+}
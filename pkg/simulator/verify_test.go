@@ -0,0 +1,66 @@
+package simulator
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ladecadence/GBShooperGo/pkg/flashcart"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		ram  bool
+		// a flash byte already programmed to 0x00, -1 for none
+		programmed int
+		// a smaller RAM, mirrored past its end so it holds the end of the
+		// file
+		ramSize int
+		// first mismatch expected, nil when it verifies
+		first *flashcart.Mismatch
+	}{
+		{"flash", false, -1, 0, nil},
+		{"RAM", true, -1, 0, nil},
+		{"flash not erased", false, 0x4123, 0, &flashcart.Mismatch{Address: 0x4123, Bank: 1, Actual: 0x00}},
+		{"RAM mirrored", true, -1, flashcart.S_2K, &flashcart.Mismatch{Address: 0, Bank: 0}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename, data := image(t, t.TempDir(), "image.bin", flashcart.S_32K, int64(i))
+			d := New()
+			if tt.programmed >= 0 {
+				d.Flash[tt.programmed] = 0x00
+			}
+			if tt.ramSize > 0 {
+				d.RAM = make([]uint8, tt.ramSize)
+			}
+			s := session(d)
+			s.Verify = true
+			err := run(func(f chan bool, p chan int64, e chan error) error {
+				if tt.ram {
+					return s.WriteRAM(ctx, filename, f, p, e)
+				}
+				return s.WriteFlash(ctx, filename, f, p, e)
+			})
+			if tt.first == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var verr *flashcart.VerifyError
+			if !errors.As(err, &verr) {
+				t.Fatalf("got error %v", err)
+			}
+			m := verr.Mismatches[0]
+			if m.Address != tt.first.Address || m.Bank != tt.first.Bank || m.Expected != data[m.Address] {
+				t.Fatalf("first mismatch %+v, want at 0x%06x bank %d", m, tt.first.Address, tt.first.Bank)
+			}
+			if tt.ramSize == 0 && m.Actual != tt.first.Actual {
+				t.Fatalf("read 0x%02x, want 0x%02x", m.Actual, tt.first.Actual)
+			}
+		})
+	}
+}